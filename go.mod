@@ -6,8 +6,12 @@ require github.com/rabbitmq/amqp091-go v1.10.0
 
 require (
 	github.com/fatih/color v1.17.0
+	github.com/go-openapi/runtime v0.23.3
+	github.com/go-openapi/strfmt v0.21.2
 	github.com/joho/godotenv v1.5.1
 	github.com/netbox-community/go-netbox v0.0.0-20230225105939-fe852c86b3d6
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/time v0.5.0
 )
 
 require (
@@ -19,9 +23,7 @@ require (
 	github.com/go-openapi/jsonpointer v0.19.5 // indirect
 	github.com/go-openapi/jsonreference v0.19.6 // indirect
 	github.com/go-openapi/loads v0.21.1 // indirect
-	github.com/go-openapi/runtime v0.23.3 // indirect
 	github.com/go-openapi/spec v0.20.4 // indirect
-	github.com/go-openapi/strfmt v0.21.2 // indirect
 	github.com/go-openapi/swag v0.21.1 // indirect
 	github.com/go-openapi/validate v0.21.0 // indirect
 	github.com/go-stack/stack v1.8.1 // indirect
@@ -3,29 +3,120 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/KittenConnect/rh-api/model"
 	"github.com/KittenConnect/rh-api/util"
 	"github.com/joho/godotenv"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func failWithError(err error, formatString string, args ...any) {
 	if err != nil {
-		util.Err(fmt.Errorf(fmt.Sprintf("%s: %w",formatString), append(args, err)...).Error())
+		util.Err(fmt.Errorf(formatString+": %w", append(args, err)...).Error())
 	}
 }
 
 var RETRY_DELAY = 5
 
+const consumerTag = "consumer"
+
+// dialBroker connect to RabbitMQ with the TLS (RABBITMQ_TLS_*) and connection settings of the environment
+// TLS is used with amqps:// URLs, RABBITMQ_AUTH_MECHANISM=EXTERNAL authenticates with the client certificate
+func dialBroker(url string) (*amqp.Connection, error) {
+	uri, err := amqp.ParseURI(url)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := util.GetEnvTLSConfig("RABBITMQ")
+	if err != nil {
+		return nil, err
+	}
+
+	//TLS is only negotiated on amqps:// URLs, its settings would be silently ignored otherwise
+	mechanism := strings.ToUpper(os.Getenv("RABBITMQ_AUTH_MECHANISM"))
+	if uri.Scheme != "amqps" && (tlsConfig != nil || mechanism == "EXTERNAL") {
+		return nil, errors.New("RABBITMQ_TLS_* and RABBITMQ_AUTH_MECHANISM=EXTERNAL require an amqps:// RABBITMQ_URL")
+	}
+
+	properties := amqp.NewConnectionProperties()
+	properties.SetClientConnectionName(util.GetEnv("RABBITMQ_CONNECTION_NAME", "rh-api"))
+
+	config := amqp.Config{
+		Vhost:           os.Getenv("RABBITMQ_VHOST"),
+		Heartbeat:       util.GetEnvDuration("RABBITMQ_HEARTBEAT", 10*time.Second),
+		TLSClientConfig: tlsConfig,
+		Properties:      properties,
+		Locale:          "en_US",
+	}
+
+	//Without mechanism, the URL decides (credentials or auth_mechanism parameter)
+	switch mechanism {
+	case "":
+	case "EXTERNAL":
+		config.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	case "PLAIN":
+		config.SASL = []amqp.Authentication{uri.PlainAuth()}
+	default:
+		return nil, fmt.Errorf("unsupported RABBITMQ_AUTH_MECHANISM %s", mechanism)
+	}
+
+	return amqp.DialConfig(url, config)
+}
+
+// settle acknowledge the delivery once handled, or give it back to the queue when requeue is set
+func settle(d amqp.Delivery, requeue bool) {
+	var err error
+	if requeue {
+		err = d.Nack(false, true)
+	} else {
+		err = d.Ack(false)
+	}
+
+	if err != nil {
+		util.Warn("Error acknowledging message: %s", err)
+	}
+}
+
+// bootstrap create the netbox schema rh-api needs, then report what it changed
+func bootstrap(ctx context.Context) {
+	netbox := model.NewNetbox()
+	err := netbox.Connect(ctx)
+	failWithError(err, "Failed to connect to netbox")
+
+	changes, err := netbox.Bootstrap(ctx)
+	for _, change := range changes {
+		util.Success("%s", change)
+	}
+	failWithError(err, "Failed to bootstrap netbox")
+
+	if len(changes) == 0 {
+		util.Info("Netbox is already bootstrapped, nothing changed")
+	}
+}
+
 func main() {
 	err := godotenv.Load()
 	failWithError(err, "Error loading .env file")
 
-	conn, err := amqp.Dial(os.Getenv("RABBITMQ_URL"))
+	//Cancelled on shutdown, every netbox call derives from it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		bootstrap(ctx)
+		return
+	}
+
+	conn, err := dialBroker(os.Getenv("RABBITMQ_URL"))
 	failWithError(err, "Failed to connect to broker")
 
 	defer conn.Close()
@@ -86,20 +177,26 @@ func main() {
 	failWithError(err, "Failed to bind queue %s to exchange %s", incomingQueue, incomingQueue)
 
 	// Consommation des messages
-	msgs, err := ch.Consume(
-		inQ.Name,   // nom de la queue
-		"consumer", // consumer
-		true,       // autoAck
-		false,      // exclusive
-		false,      // noLocal
-		false,      // noWait
-		nil,        // arguments
-	)
-	failWithError(err, "Failed to register %s consumer", inQ.Name)
+	consume := func() <-chan amqp.Delivery {
+		msgs, err := ch.Consume(
+			inQ.Name,    // nom de la queue
+			consumerTag, // consumer
+			false,       // autoAck, deliveries are settled once handled so none is lost on pause
+			false,       // exclusive
+			false,       // noLocal
+			false,       // noWait
+			nil,         // arguments
+		)
+		failWithError(err, "Failed to register %s consumer", inQ.Name)
+
+		return msgs
+	}
+
+	msgs := consume()
 	util.Info("Connected to message broker")
 
 	netbox := model.NewNetbox()
-	err = netbox.Connect()
+	err = netbox.Connect(ctx)
 	failWithError(err, "Failed to connect to netbox")
 
 	if netbox.IsConnected() == false {
@@ -107,24 +204,137 @@ func main() {
 		os.Exit(-1)
 	}
 
-	// Canal pour signaler la fin du programme
-	forever := make(chan bool)
+	//Opened last, fatal errors exit without running deferred calls
+	if path := os.Getenv("NETBOX_STATE_FILE"); path != "" {
+		netbox.Registry, err = model.OpenRegistry(path)
+		failWithError(err, "Failed to open state file")
+	}
+
+	//Metrics are published by expvar on /debug/vars
+	if addr := os.Getenv("METRICS_LISTEN_ADDR"); addr != "" {
+		go func() {
+			err := http.ListenAndServe(addr, nil)
+			util.Warn("Metrics endpoint stopped: %s", err)
+		}()
+	}
+
+	if interval := util.GetEnvDuration("NETBOX_VALIDATE_INTERVAL", 5*time.Minute); interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				//Every run must end before the next one
+				runCtx, cancel := context.WithTimeout(ctx, interval)
+				err := netbox.Validate(runCtx)
+				cancel()
+
+				if err != nil {
+					util.Warn("Netbox validation failed: %s", err)
+				}
+			}
+		}()
+	}
+
+	if interval := util.GetEnvDuration("NETBOX_IP_CLEANUP_INTERVAL", 0); interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				runCtx, cancel := context.WithTimeout(ctx, interval)
+				count, err := netbox.CleanupReleasedIPs(runCtx)
+				cancel()
+
+				if err != nil {
+					util.Warn("Error cleaning up released IPs: %s", err)
+				} else if count > 0 {
+					util.Success("Cleaned up %d released IP(s)", count)
+				}
+			}
+		}()
+	}
+
+	if interval := util.GetEnvDuration("NETBOX_RECONCILE_INTERVAL", 0); interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				runCtx, cancel := context.WithTimeout(ctx, interval)
+				report, err := netbox.Reconcile(runCtx)
+				cancel()
+
+				if err != nil {
+					util.Warn("Error reconciling netbox: %s", err)
+					continue
+				}
+
+				util.Info("Reconciliation checked %d host(s): %d drifted, %d corrected, %d VM(s) unknown to rh-api",
+					report.Checked, len(report.Drifts), report.Corrected, len(report.Unknown))
+			}
+		}()
+	}
+
+	// Durée maximale de traitement d'un message
+	messageTimeout := util.GetEnvDuration("NETBOX_MESSAGE_TIMEOUT", 2*time.Minute)
 
 	go func() {
-		for d := range msgs {
+		paused := false
+		for {
+			var d amqp.Delivery
+			var ok bool
+
+			select {
+			case d, ok = <-msgs:
+				if !ok {
+					//Consumer cancelled, wait for netbox to come back
+					msgs = nil
+					continue
+				}
+
+			case open := <-netbox.CircuitChanges():
+				if open == paused {
+					continue
+				}
+				paused = open
+
+				if open {
+					util.Warn("Netbox is unavailable, pausing consumption of %s", inQ.Name)
+					if err := ch.Cancel(consumerTag, false); err != nil {
+						util.Warn("Error cancelling consumer: %s", err)
+					}
+				} else {
+					util.Info("Netbox is available, resuming consumption of %s", inQ.Name)
+					msgs = consume()
+				}
+				continue
+			}
+
 			go func() {
 				msg := model.Message{Timestamp: d.Timestamp, FailCount: 20}
 				err := json.Unmarshal(d.Body, &msg)
 				if err != nil {
 					util.Warn("Error unmarshalling message : %w", err)
+					settle(d, false)
 					return
 				}
 
+				if msg.MessageId == "" {
+					msg.MessageId = d.MessageId
+				}
+
 				//Make request to the rest of API
-				err = netbox.CreateOrUpdateVM(msg)
+				msgCtx, msgCancel := context.WithTimeout(ctx, messageTimeout)
+				defer msgCancel()
+
+				err = netbox.CreateOrUpdateVM(msgCtx, &msg)
 				if err != nil {
 					util.Warn("error creating or updating VM : %w", err)
 
+					//Deliveries refused while netbox is down wait in the queue until consumption resumes
+					if errors.Is(err, model.ErrCircuitOpen) {
+						settle(d, true)
+						return
+					}
+
+					if errors.Is(err, model.ErrPermanent) {
+						util.Warn("Dropping message of %s, retrying it can't succeed", msg.Hostname)
+						settle(d, false)
+						return
+					}
+
 					dur, _ := time.ParseDuration("10s")
 					ctx, cancel := context.WithTimeout(context.Background(), dur)
 					defer cancel()
@@ -133,6 +343,7 @@ func main() {
 					newMsg.FailCount--
 
 					if newMsg.FailCount <= 0 {
+						settle(d, false)
 						return
 					}
 
@@ -155,9 +366,12 @@ func main() {
 						})
 
 					if chErr != nil {
+						//Requeued as is, the retry is not lost
 						util.Warn("Error re-publishing message: %s", chErr)
+						settle(d, true)
 					} else {
 						util.Warn("Re-sent message to RabbitMQ®️: %s", newMsgJson)
+						settle(d, false)
 					}
 
 					return
@@ -189,10 +403,17 @@ func main() {
 				} else {
 					util.Success("sent success message to RabbitMQ®️: %s", newMsgJson)
 				}
+
+				settle(d, false)
 			}()
 		}
 	}()
 
 	util.Info(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+	<-ctx.Done()
+	util.Info("Shutting down")
+
+	if err := netbox.Registry.Close(); err != nil {
+		util.Warn("Error closing state file: %s", err)
+	}
 }
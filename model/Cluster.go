@@ -1,5 +1,50 @@
 package model
 
+import (
+	"context"
+	"fmt"
+	"github.com/netbox-community/go-netbox/netbox/client/virtualization"
+	"strconv"
+)
+
 type Cluster struct {
-	ID int64 `json:"id"`
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// GetCluster resolve the cluster of the message to its netbox ID
+// An empty Cluster is returned when no placement is configured
+func (n *Netbox) GetCluster(ctx context.Context, msg Message) (Cluster, error) {
+	name := n.Clusters.Value(msg.Cluster, msg.Hostname)
+
+	id, err := n.Clusters.Resolve(ctx, msg.Cluster, msg.Hostname, n.fetchClusterId)
+	if err != nil || id == nil {
+		return Cluster{}, err
+	}
+
+	return Cluster{ID: *id, Name: name}, nil
+}
+
+// fetchClusterId look a cluster up by ID or name
+// Netbox clusters have no slug, the name is matched case-insensitively instead
+func (n *Netbox) fetchClusterId(ctx context.Context, name string) (int64, error) {
+	params := virtualization.NewVirtualizationClustersListParams().
+		WithContext(ctx)
+
+	if _, err := strconv.ParseInt(name, 10, 64); err == nil {
+		params.SetID(&name)
+	} else {
+		params.SetNameIe(&name)
+	}
+
+	res, err := n.Client.Virtualization.VirtualizationClustersList(params, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error listing clusters: %w", err)
+	}
+
+	if *res.Payload.Count != 1 {
+		return 0, fmt.Errorf("expected 1 cluster named %s, got %d", name, *res.Payload.Count)
+	}
+
+	return res.Payload.Results[0].ID, nil
 }
@@ -0,0 +1,162 @@
+package model
+
+import (
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Custom field types understood by the mapping, named after the netbox ones
+const (
+	CustomFieldText     = "text"
+	CustomFieldInteger  = "integer"
+	CustomFieldDecimal  = "decimal"
+	CustomFieldBoolean  = "boolean"
+	CustomFieldDate     = "date"
+	CustomFieldDatetime = "datetime"
+	CustomFieldJSON     = "json"
+)
+
+// serialCustomField holds the VM serial, it is always written
+const serialCustomField = "kc_serial_"
+
+// CustomFieldMapping copy a message attribute to a netbox custom field
+type CustomFieldMapping struct {
+	Attribute string
+	Field     string
+	Type      string
+}
+
+// parseCustomFieldMappings read a list of attribute=field[:type] entries from the environment
+// e.g. "os_version=kc_os_version,boot_time=kc_boot_time:datetime"
+func parseCustomFieldMappings(key string) []CustomFieldMapping {
+	var mappings []CustomFieldMapping
+
+	for attribute, target := range util.GetEnvMap(key) {
+		field, fieldType, _ := strings.Cut(target, ":")
+		if fieldType == "" {
+			fieldType = CustomFieldText
+		}
+
+		switch fieldType {
+		case CustomFieldText, CustomFieldInteger, CustomFieldDecimal, CustomFieldBoolean,
+			CustomFieldDate, CustomFieldDatetime, CustomFieldJSON:
+		default:
+			util.Warn("Ignoring custom field mapping %s: unknown type %s", attribute, fieldType)
+			continue
+		}
+
+		mappings = append(mappings, CustomFieldMapping{Attribute: attribute, Field: field, Type: fieldType})
+	}
+
+	return mappings
+}
+
+// MapCustomFields build the netbox custom fields of the message attributes
+// Attributes which can't be converted are skipped with a warning
+func (n *Netbox) MapCustomFields(attributes map[string]interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+
+	for _, mapping := range n.CustomFieldMappings {
+		value, ok := attributes[mapping.Attribute]
+		if !ok || value == nil {
+			continue
+		}
+
+		converted, err := coerceCustomField(value, mapping.Type)
+		if err != nil {
+			util.Warn("Unable to map attribute %s to custom field %s: %s", mapping.Attribute, mapping.Field, err)
+			continue
+		}
+
+		fields[mapping.Field] = converted
+	}
+
+	return fields
+}
+
+// customFieldTypes return the type of every mapped custom field, by field name
+func (n *Netbox) customFieldTypes() map[string]string {
+	types := make(map[string]string, len(n.CustomFieldMappings))
+	for _, mapping := range n.CustomFieldMappings {
+		types[mapping.Field] = mapping.Type
+	}
+
+	return types
+}
+
+// coerceCustomField convert a JSON decoded value to the representation netbox expects for the type
+func coerceCustomField(value interface{}, fieldType string) (interface{}, error) {
+	switch fieldType {
+	case CustomFieldText:
+		return fmt.Sprint(value), nil
+
+	case CustomFieldInteger:
+		switch v := value.(type) {
+		case float64:
+			//Truncating would silently record another value
+			if v != math.Trunc(v) || v >= math.MaxInt64 || v < math.MinInt64 {
+				return nil, fmt.Errorf("%v is not an integer", v)
+			}
+			return int64(v), nil
+		case string:
+			return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		}
+
+	case CustomFieldDecimal:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+
+	case CustomFieldBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			return v != 0, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(v))
+		}
+
+	case CustomFieldDate, CustomFieldDatetime:
+		t, err := parseTime(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if fieldType == CustomFieldDate {
+			return t.Format(time.DateOnly), nil
+		}
+
+		return t.Format(time.RFC3339), nil
+
+	case CustomFieldJSON:
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("cannot convert %T to %s", value, fieldType)
+}
+
+// parseTime read a unix timestamp or a RFC3339 / date string
+func parseTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case float64:
+		return time.Unix(int64(v), 0).UTC(), nil
+	case string:
+		for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return t, nil
+			}
+		}
+
+		return time.Time{}, fmt.Errorf("unrecognized time %q", v)
+	}
+
+	return time.Time{}, fmt.Errorf("cannot convert %T to a time", value)
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/netbox-community/go-netbox/netbox/client/extras"
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Tag modes, telling if the message tags are added to the VM ones or replace them
+const (
+	TagModeAdditive      = "additive"
+	TagModeAuthoritative = "authoritative"
+)
+
+var slugInvalidChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// tagCache remember the netbox tags resolved by slug, rh-api never changes them
+type tagCache struct {
+	mu   sync.Mutex
+	tags map[string]*models.NestedTag
+}
+
+func newTagCache() *tagCache {
+	return &tagCache{tags: map[string]*models.NestedTag{}}
+}
+
+func (c *tagCache) get(slug string) (*models.NestedTag, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tag, ok := c.tags[slug]
+	return tag, ok
+}
+
+func (c *tagCache) set(slug string, tag *models.NestedTag) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tags[slug] = tag
+}
+
+// Slugify build a netbox compatible slug from a name
+func Slugify(name string) string {
+	return strings.Trim(slugInvalidChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// EnsureTags return the netbox tags matching the names, creating the missing ones
+func (n *Netbox) EnsureTags(ctx context.Context, names []string) ([]*models.NestedTag, error) {
+	tags := make([]*models.NestedTag, 0, len(names))
+
+	for _, name := range names {
+		name := strings.TrimSpace(name)
+		slug := Slugify(name)
+		if slug == "" {
+			continue
+		}
+
+		tag, ok := n.tags.get(slug)
+		if !ok {
+			var err error
+			tag, err = n.findTag(ctx, name, slug)
+			if err == nil && tag == nil {
+				tag, err = n.createTag(ctx, name, slug)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			n.tags.set(slug, tag)
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
+
+// findTag return the netbox tag with the slug, or else with the name, nil if there is none
+// A tag created by hand may have a slug differing from the one rh-api derives from its name
+func (n *Netbox) findTag(ctx context.Context, name string, slug string) (*models.NestedTag, error) {
+	bySlug := extras.NewExtrasTagsListParams().
+		WithSlug(&slug).
+		WithContext(ctx)
+	byName := extras.NewExtrasTagsListParams().
+		WithName(&name).
+		WithContext(ctx)
+
+	for _, params := range []*extras.ExtrasTagsListParams{bySlug, byName} {
+		res, err := n.Client.Extras.ExtrasTagsList(params, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error listing tags: %w", err)
+		}
+
+		if *res.Payload.Count > 0 {
+			t := res.Payload.Results[0]
+			return &models.NestedTag{ID: t.ID, Name: t.Name, Slug: t.Slug}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (n *Netbox) createTag(ctx context.Context, name string, slug string) (*models.NestedTag, error) {
+	createParams := extras.NewExtrasTagsCreateParams().
+		WithData(&models.Tag{Name: &name, Slug: &slug, Color: n.TagColor}).
+		WithContext(ctx)
+	created, err := n.Client.Extras.ExtrasTagsCreate(createParams, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tag %s: %w", slug, err)
+	}
+
+	util.Success("Created tag %s", slug)
+	return &models.NestedTag{ID: created.Payload.ID, Name: &name, Slug: &slug}, nil
+}
+
+// withoutTag return the tags without the one matching the slug, and if it was found
+func withoutTag(tags []*models.NestedTag, slug string) ([]*models.NestedTag, bool) {
+	kept := make([]*models.NestedTag, 0, len(tags))
+	for _, t := range tags {
+		if t.Slug != nil && *t.Slug == slug {
+			continue
+		}
+		kept = append(kept, t)
+	}
+
+	return mergeTags(kept, nil), len(kept) < len(tags)
+}
+
+// mergeTags return the current tags followed by the wanted ones which are missing
+func mergeTags(current []*models.NestedTag, wanted []*models.NestedTag) []*models.NestedTag {
+	merged := make([]*models.NestedTag, 0, len(current)+len(wanted))
+	seen := map[string]bool{}
+
+	for _, tags := range [][]*models.NestedTag{current, wanted} {
+		for _, t := range tags {
+			if t.Slug == nil || seen[*t.Slug] {
+				continue
+			}
+
+			//Only keep lookup fields, netbox rejects read-only ones like url or display
+			seen[*t.Slug] = true
+			merged = append(merged, &models.NestedTag{ID: t.ID, Name: t.Name, Slug: t.Slug})
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// VirtualDisk is a disk reported by the agent, Size is in GB
+type VirtualDisk struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// netboxVirtualDisk is the netbox representation of a virtual disk (netbox >= 3.7), Size is in GB before netbox 4.0 and in MB since
+type netboxVirtualDisk struct {
+	ID             int64  `json:"id,omitempty"`
+	VirtualMachine int64  `json:"virtual_machine,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Size           int64  `json:"size"`
+}
+
+type netboxVirtualDiskList struct {
+	Count   int64                `json:"count"`
+	Results []*netboxVirtualDisk `json:"results"`
+}
+
+const virtualDisksPath = "/virtualization/virtual-disks/"
+
+// GetVirtualDisks list the virtual disks of the VM, indexed by name
+func (vm *VirtualMachine) GetVirtualDisks(ctx context.Context) (map[string]*netboxVirtualDisk, error) {
+	disks := map[string]*netboxVirtualDisk{}
+
+	//VMs planned by the dry-run mode have a fake negative ID, which netbox refuses as a filter, they have no disk yet
+	if vm.NetboxId < 0 {
+		return disks, nil
+	}
+
+	query := url.Values{
+		"virtual_machine_id": {strconv.FormatInt(vm.NetboxId, 10)},
+		"limit":              {"0"},
+	}
+
+	var list netboxVirtualDiskList
+	err := vm.n.rawRequest(ctx, http.MethodGet, virtualDisksPath, query, nil, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range list.Results {
+		disks[d.Name] = d
+	}
+
+	return disks, nil
+}
+
+// SyncVirtualDisks create or resize the virtual disks reported by the agent
+// Disks unknown to the agent are kept, they may have been added by hand
+func (vm *VirtualMachine) SyncVirtualDisks(ctx context.Context, disks []VirtualDisk) error {
+	caps := vm.n.Capabilities()
+	if len(disks) == 0 || !caps.VirtualDisks {
+		return nil
+	}
+
+	existing, err := vm.GetVirtualDisks(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing virtual disks: %w", err)
+	}
+
+	for _, disk := range disks {
+		size := caps.diskSize(disk.Size)
+
+		current, ok := existing[disk.Name]
+		if !ok {
+			data := &netboxVirtualDisk{VirtualMachine: vm.NetboxId, Name: disk.Name, Size: size}
+			if err := vm.n.rawRequest(ctx, http.MethodPost, virtualDisksPath, nil, data, nil); err != nil {
+				return fmt.Errorf("error creating virtual disk %s: %w", disk.Name, err)
+			}
+
+			util.Success("\tCreated virtual disk %s (%d GB) on VM #%d", disk.Name, disk.Size, vm.NetboxId)
+			continue
+		}
+
+		if current.Size == size {
+			continue
+		}
+
+		path := virtualDisksPath + strconv.FormatInt(current.ID, 10) + "/"
+		if err := vm.n.rawRequest(ctx, http.MethodPatch, path, nil, &netboxVirtualDisk{Size: size}, nil); err != nil {
+			return fmt.Errorf("error resizing virtual disk %s: %w", disk.Name, err)
+		}
+
+		util.Success("\tResized virtual disk %s to %d GB on VM #%d", disk.Name, disk.Size, vm.NetboxId)
+	}
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"fmt"
 	"github.com/KittenConnect/rh-api/util"
 	"github.com/netbox-community/go-netbox/netbox/client/ipam"
@@ -8,6 +9,7 @@ import (
 	"github.com/netbox-community/go-netbox/netbox/models"
 	"net"
 	"strconv"
+	"strings"
 )
 
 type VirtualMachine struct {
@@ -17,76 +19,227 @@ type VirtualMachine struct {
 	Status   string  `json:"status"`
 	Serial   string  `json:"serial"`
 
+	Placement Placement `json:"-"`
+
+	Vcpus  float64       `json:"vcpus"`
+	Memory int64         `json:"memory"`
+	Disk   int64         `json:"disk"`
+	Disks  []VirtualDisk `json:"disks"`
+
+	Tags []*models.NestedTag `json:"tags"`
+
+	CustomFields map[string]interface{} `json:"custom_fields"`
+
 	ManagementIP net.IP `json:"management_ip"`
 	n            *Netbox
+
+	// Prefix encloses the management IP, it is resolved by the prefix policy
+	Prefix *models.Prefix `json:"-"`
+
+	// ManagementInterfaceId and ManagementIPId are the netbox objects the management IP resolved to
+	ManagementInterfaceId int64 `json:"-"`
+	ManagementIPId        int64 `json:"-"`
+
+	// source describe the message driving the changes, for journal entries
+	source string
+
+	// PreviousIPOwner is set when the management IP was taken from another VM
+	PreviousIPOwner *IPOwner `json:"previous_ip_owner,omitempty"`
 }
 
 var (
 	mgmtInterfaceName = "mgmt"
 )
 
+// vmStatuses are the netbox VM statuses a message can set
+var vmStatuses = []string{
+	models.VirtualMachineWithConfigContextStatusValueOffline,
+	models.VirtualMachineWithConfigContextStatusValueActive,
+	models.VirtualMachineWithConfigContextStatusValuePlanned,
+	models.VirtualMachineWithConfigContextStatusValueStaged,
+	models.VirtualMachineWithConfigContextStatusValueFailed,
+	models.VirtualMachineWithConfigContextStatusValueDecommissioning,
+}
+
 func NewVM(n *Netbox, msg Message) *VirtualMachine {
 	vm := &VirtualMachine{
 		n:        n,
 		NetboxId: -1,
 
-		Name: msg.Hostname,
+		Name:   msg.Hostname,
+		Status: msg.Status,
+		Serial: msg.GetSerial(),
+
+		Vcpus:  msg.Vcpus,
+		Memory: msg.Memory,
+		Disk:   msg.Disk,
+		Disks:  msg.Disks,
+
+		CustomFields: n.MapCustomFields(msg.Attributes),
+
+		source: journalSource(msg),
 	}
 
 	return vm
 }
 
-func (vm *VirtualMachine) Get() models.WritableVirtualMachineWithConfigContext {
-	// todo: implement netbox func
-	return models.WritableVirtualMachineWithConfigContext{
-		Cluster: &vm.Cluster.ID,
-		Name:    &vm.Name,
-		Status:  vm.Status,
+// DNSName return the FQDN of the VM management IP, or an empty string if no domain is configured
+func (vm *VirtualMachine) DNSName() string {
+	domain := vm.n.DNSDomain
+	if d, ok := vm.n.ClusterDNSDomains[vm.Cluster.Name]; ok {
+		domain = d
+	} else if d, ok := vm.n.ClusterDNSDomains[strconv.FormatInt(vm.Cluster.ID, 10)]; ok {
+		domain = d
+	}
 
-		CustomFields: map[string]interface{}{
-			"kc_serial_": vm.Serial,
-		},
+	if domain == "" || vm.Name == "" {
+		return ""
 	}
+
+	return strings.ToLower(vm.Name) + "." + strings.Trim(domain, ".")
 }
 
-func (vm *VirtualMachine) Create(msg Message) (*virtualization.VirtualizationVirtualMachinesCreateCreated, error) {
+func (vm *VirtualMachine) Get() models.WritableVirtualMachineWithConfigContext {
+	customFields := map[string]interface{}{}
+	for k, v := range vm.CustomFields {
+		customFields[k] = v
+	}
+	customFields[serialCustomField] = vm.Serial
+
 	conf := models.WritableVirtualMachineWithConfigContext{
-		Cluster: &vm.Cluster.ID,
-		Name:    &vm.Name,
-		Status:  vm.Status,
+		Name:   &vm.Name,
+		Status: vm.Status,
 
-		CustomFields: map[string]interface{}{
-			"kc_serial_": msg.GetSerial(),
-		},
+		CustomFields: customFields,
 	}
 
-	params := virtualization.NewVirtualizationVirtualMachinesCreateParams().WithData(&conf)
+	//Leave the cluster untouched when no placement is configured
+	if vm.Cluster.ID > 0 {
+		conf.Cluster = &vm.Cluster.ID
+	}
+
+	vm.Placement.Apply(&conf)
+
+	//Unreported resources are left untouched
+	if vm.Vcpus > 0 {
+		conf.Vcpus = &vm.Vcpus
+	}
+
+	if vm.Memory > 0 {
+		conf.Memory = &vm.Memory
+	}
+
+	caps := vm.n.Capabilities()
+	disk := vm.Disk
+	if disk == 0 && !caps.VirtualDisks {
+		//Without virtual disks, only their total size can be recorded
+		for _, d := range vm.Disks {
+			disk += d.Size
+		}
+	}
+
+	//With virtual disks, netbox computes the total disk size itself
+	if disk > 0 && (len(vm.Disks) == 0 || !caps.VirtualDisks) {
+		size := caps.diskSize(disk)
+		conf.Disk = &size
+	}
+
+	//An empty, but set, list removes every tag
+	if vm.Tags != nil {
+		conf.Tags = vm.Tags
+	}
+
+	return conf
+}
+
+func (vm *VirtualMachine) Create(ctx context.Context, msg Message) (*virtualization.VirtualizationVirtualMachinesCreateCreated, error) {
+	conf := vm.Get()
+
+	params := virtualization.NewVirtualizationVirtualMachinesCreateParams().
+		WithData(&conf).
+		WithContext(ctx)
 	return vm.n.Client.Virtualization.VirtualizationVirtualMachinesCreate(params, nil)
 }
 
-func (vm *VirtualMachine) CreateOrUpdate(msg Message) {
+// Read fetch the current state of the VM from netbox
+func (vm *VirtualMachine) Read(ctx context.Context) (*models.VirtualMachineWithConfigContext, error) {
+	params := virtualization.NewVirtualizationVirtualMachinesReadParams().
+		WithID(vm.NetboxId).
+		WithContext(ctx)
+	res, err := vm.n.Client.Virtualization.VirtualizationVirtualMachinesRead(params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading virtual machine #%d: %w", vm.NetboxId, err)
+	}
+
+	return res.Payload, nil
+}
+
+// SetTags resolve the message tags and apply the tag mode against the current VM tags
+// current is nil for VMs which are not created yet
+// In authoritative mode, a message without tags removes those of the VM
+func (vm *VirtualMachine) SetTags(ctx context.Context, names []string, current *models.VirtualMachineWithConfigContext) error {
+	if len(names) == 0 && (vm.n.TagMode != TagModeAuthoritative || current == nil) {
+		return nil
+	}
+
+	tags, err := vm.n.EnsureTags(ctx, names)
+	if err != nil {
+		return err
+	}
+
+	if vm.n.TagMode == TagModeAuthoritative || current == nil {
+		vm.Tags = tags
+		return nil
+	}
+
+	vm.Tags = mergeTags(current.Tags, tags)
+	return nil
+}
+
+func (vm *VirtualMachine) CreateOrUpdate(ctx context.Context, msg Message) {
 	//
 }
 
 // Update vm infos to netbox
-func (vm *VirtualMachine) Update() error {
-	data := vm.Get()
+// Only the fields differing from the current netbox state are sent, nothing is sent when they all match
+func (vm *VirtualMachine) Update(ctx context.Context, current *models.VirtualMachineWithConfigContext) error {
+	data, changed := vm.Diff(current)
+	if len(changed) == 0 {
+		util.Info("VM #%d is already up to date", vm.NetboxId)
+		return nil
+	}
+
+	object, err := toObject(&data)
+	if err != nil {
+		return err
+	}
 
-	updateParams := &virtualization.VirtualizationVirtualMachinesPartialUpdateParams{
-		Data: &data,
-		ID:   vm.NetboxId,
+	//Tags are omitted when empty, so they are set on the generic form to remove the last ones
+	if data.Tags != nil {
+		object["tags"] = data.Tags
 	}
 
-	_, err := vm.n.Client.Virtualization.
-		VirtualizationVirtualMachinesPartialUpdate(updateParams.WithTimeout(vm.n.GetDefaultTimeout()), nil)
+	err = vm.n.writeObject(ctx, "/virtualization/virtual-machines/", vm.NetboxId, object, nil)
+	vm.n.cache.forgetVM(*current.Name, vmSerial(current))
 	if err != nil {
-		return fmt.Errorf("error updating virtual machine interface: %w", err)
+		return fmt.Errorf("error updating virtual machine: %w", err)
+	}
+
+	util.Success("Updated %s of VM #%d", strings.Join(changed, ", "), vm.NetboxId)
+
+	if data.Status != "" {
+		previous := "none"
+		if current.Status != nil && current.Status.Value != nil {
+			previous = *current.Status.Value
+		}
+
+		vm.Journal(ctx, models.JournalEntryKindValueInfo, "Status changed from %s to %s", previous, data.Status)
 	}
 
 	return nil
 }
 
-func (vm *VirtualMachine) GetInterfaces(name string) (*virtualization.VirtualizationInterfacesListOK, error) {
+func (vm *VirtualMachine) GetInterfaces(ctx context.Context, name string) (*virtualization.VirtualizationInterfacesListOK, error) {
 	vmId := strconv.FormatInt(vm.NetboxId, 10)
 
 	ipIfParam := &virtualization.VirtualizationInterfacesListParams{
@@ -94,7 +247,7 @@ func (vm *VirtualMachine) GetInterfaces(name string) (*virtualization.Virtualiza
 		Name:             &name,
 	}
 	interfaces, err := vm.n.Client.Virtualization.
-		VirtualizationInterfacesList(ipIfParam.WithTimeout(vm.n.GetDefaultTimeout()), nil)
+		VirtualizationInterfacesList(ipIfParam.WithContext(ctx), nil)
 	if err != nil {
 		return nil, fmt.Errorf("error listing virtual machine interfaces: %w", err)
 	}
@@ -102,7 +255,7 @@ func (vm *VirtualMachine) GetInterfaces(name string) (*virtualization.Virtualiza
 	return interfaces, nil
 }
 
-func (vm *VirtualMachine) GetInterfaceByID(id int64) (*models.VMInterface, error) {
+func (vm *VirtualMachine) GetInterfaceByID(ctx context.Context, id int64) (*models.VMInterface, error) {
 	vmId := strconv.FormatInt(vm.NetboxId, 10)
 	interfaceId := strconv.FormatInt(id, 10)
 
@@ -111,7 +264,7 @@ func (vm *VirtualMachine) GetInterfaceByID(id int64) (*models.VMInterface, error
 		ID:               &interfaceId,
 	}
 	i, err := vm.n.Client.Virtualization.
-		VirtualizationInterfacesList(ipIfParam.WithTimeout(vm.n.GetDefaultTimeout()), nil)
+		VirtualizationInterfacesList(ipIfParam.WithContext(ctx), nil)
 	if err != nil {
 		return nil, fmt.Errorf("error listing virtual machine interfaces: %w", err)
 	}
@@ -123,7 +276,11 @@ func (vm *VirtualMachine) GetInterfaceByID(id int64) (*models.VMInterface, error
 	return i.Payload.Results[0], nil
 }
 
-func (vm *VirtualMachine) GetManagementInterface() (*models.VMInterface, error) {
+func (vm *VirtualMachine) GetManagementInterface(ctx context.Context) (*models.VMInterface, error) {
+	if itf, ok := vm.n.cache.managementInterface(vm.NetboxId); ok {
+		return itf, nil
+	}
+
 	vmId := strconv.FormatInt(vm.NetboxId, 10)
 
 	ipIfParam := &virtualization.VirtualizationInterfacesListParams{
@@ -131,14 +288,14 @@ func (vm *VirtualMachine) GetManagementInterface() (*models.VMInterface, error)
 		Name:             &mgmtInterfaceName,
 	}
 	in, err := vm.n.Client.Virtualization.
-		VirtualizationInterfacesList(ipIfParam.WithTimeout(vm.n.GetDefaultTimeout()), nil)
+		VirtualizationInterfacesList(ipIfParam.WithContext(ctx), nil)
 	if err != nil {
 		return nil, fmt.Errorf("error listing virtual machine interfaces: %w", err)
 	}
 
 	//If there are no management interface, create it
 	if *in.Payload.Count == 0 {
-		mgmtInterface, err := vm.CreateInterface("mgmt")
+		mgmtInterface, err := vm.CreateInterface(ctx, "mgmt")
 		if err != nil {
 			return nil, fmt.Errorf("error creating virtual machine interface: %w", err)
 		}
@@ -146,10 +303,38 @@ func (vm *VirtualMachine) GetManagementInterface() (*models.VMInterface, error)
 		return mgmtInterface.Payload, nil
 	}
 
+	vm.n.cache.storeManagementInterface(vm.NetboxId, in.Payload.Results[0])
 	return in.Payload.Results[0], nil
 }
 
-func (vm *VirtualMachine) CreateInterface(ifName string) (*virtualization.VirtualizationInterfacesCreateCreated, error) {
+// GetManagementIP return the IP linked to the management interface, or nil if there is none
+func (vm *VirtualMachine) GetManagementIP(ctx context.Context) (*models.IPAddress, error) {
+	interfaces, err := vm.GetInterfaces(ctx, mgmtInterfaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if *interfaces.Payload.Count == 0 {
+		return nil, nil
+	}
+
+	mgmtInterfaceId := strconv.FormatInt(interfaces.Payload.Results[0].ID, 10)
+	params := ipam.NewIpamIPAddressesListParams().
+		WithVminterfaceID(&mgmtInterfaceId).
+		WithContext(ctx)
+	res, err := vm.n.Client.Ipam.IpamIPAddressesList(params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing management ip addresses: %w", err)
+	}
+
+	if *res.Payload.Count == 0 {
+		return nil, nil
+	}
+
+	return res.Payload.Results[0], nil
+}
+
+func (vm *VirtualMachine) CreateInterface(ctx context.Context, ifName string) (*virtualization.VirtualizationInterfacesCreateCreated, error) {
 	ifParam := models.WritableVMInterface{
 		Name:    &ifName,
 		Enabled: true,
@@ -161,7 +346,7 @@ func (vm *VirtualMachine) CreateInterface(ifName string) (*virtualization.Virtua
 	paramInterface := virtualization.
 		NewVirtualizationInterfacesCreateParams().
 		WithData(&ifParam).
-		WithTimeout(vm.n.GetDefaultTimeout())
+		WithContext(ctx)
 	res, err := vm.n.Client.Virtualization.VirtualizationInterfacesCreate(paramInterface, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating virtual machine interface: %w", err)
@@ -171,30 +356,11 @@ func (vm *VirtualMachine) CreateInterface(ifName string) (*virtualization.Virtua
 	return res, nil
 }
 
-func (vm *VirtualMachine) UpdateInterfaceIP(address string, ifId int64, objectType string) error {
-	ip := vm.n.getIpAddress(address)
-	ip.AssignedObjectID = &ifId
-	ip.AssignedObjectType = &objectType
-
-	ifUpdateParam := &ipam.IpamIPAddressesPartialUpdateParams{
-		Data: ip,
-	}
-
-	_, err := vm.n.Client.Ipam.
-		IpamIPAddressesPartialUpdate(ifUpdateParam.WithID(ip.ID).
-			WithTimeout(vm.n.GetDefaultTimeout()), nil)
-	if err != nil {
-		return fmt.Errorf("error updating ip address: %w", err)
-	}
-
-	util.Success("Update IP to VM interface")
-	return nil
-}
-
-func (vm *VirtualMachine) CreateIP(n *Netbox, address string, status string, linkedObjectId int64, linkedObjectType string) (*ipam.IpamIPAddressesCreateCreated, error) {
+func (vm *VirtualMachine) CreateIP(ctx context.Context, n *Netbox, address string, status string, linkedObjectId int64, linkedObjectType string) (*ipam.IpamIPAddressesCreateCreated, error) {
 	ip := &models.WritableIPAddress{
 		Address: &address,
 		Status:  status,
+		DNSName: vm.DNSName(),
 	}
 
 	if linkedObjectId != -1 && linkedObjectType != "" {
@@ -202,11 +368,11 @@ func (vm *VirtualMachine) CreateIP(n *Netbox, address string, status string, lin
 		ip.AssignedObjectType = &linkedObjectType
 	}
 
-	ipCreateParams := &ipam.IpamIPAddressesCreateParams{
-		Data: ip,
-	}
+	n.applyPrefixDefaults(ip, vm.Prefix)
 
-	res, err := n.Client.Ipam.IpamIPAddressesCreate(ipCreateParams.WithTimeout(n.GetDefaultTimeout()), nil)
+	res := &ipam.IpamIPAddressesCreateCreated{Payload: &models.IPAddress{}}
+	err := n.writeObject(ctx, "/ipam/ip-addresses/", 0, ip, res.Payload)
+	n.cache.forgetIP(address)
 	if err != nil {
 		return nil, fmt.Errorf("error creating ip address: %w", err)
 	}
@@ -214,24 +380,25 @@ func (vm *VirtualMachine) CreateIP(n *Netbox, address string, status string, lin
 	return res, nil
 }
 
-func (vm *VirtualMachine) UpdateManagementIP(msg Message) error {
+func (vm *VirtualMachine) UpdateManagementIP(ctx context.Context, msg Message) error {
 	//Get vm management interface
-	itf, err := vm.GetManagementInterface()
+	itf, err := vm.GetManagementInterface(ctx)
 	if err != nil {
 		return fmt.Errorf("error getting interfaces: %w", err)
 	}
 
-	objectType := "virtualization.vminterface"
+	vm.ManagementInterfaceId = itf.ID
 
-	//Update management interface with latest IP
-	err = vm.UpdateInterfaceIP(msg.IpAddress, itf.ID, objectType)
-	if err != nil {
-		return err
+	//A cached IP already linked to the interface spares listing them
+	if ip, ok := vm.n.cache.ip(msg.IpAddress); ok && ip.AssignedObjectID != nil && *ip.AssignedObjectID == itf.ID {
+		vm.ManagementIPId = ip.ID
+		return vm.SyncDNSName(ctx, ip)
 	}
 
 	var mgmtInterfaceId = strconv.FormatInt(itf.ID, 10)
-	params := ipam.NewIpamIPAddressesListParams()
-	params.SetVminterfaceID(&mgmtInterfaceId)
+	params := ipam.NewIpamIPAddressesListParams().
+		WithVminterfaceID(&mgmtInterfaceId).
+		WithContext(ctx)
 
 	result, err := vm.n.Client.Ipam.IpamIPAddressesList(params, nil)
 	if err != nil {
@@ -245,104 +412,78 @@ func (vm *VirtualMachine) UpdateManagementIP(msg Message) error {
 		return fmt.Errorf("there are more than one management ip linked to the management interface")
 	}
 
+	var previous *models.IPAddress
 	if *ipCount == 1 {
-		ip := result.Payload.Results[0]
-		if *ip.Address == msg.IpAddress {
-			//Nothing to do
-			return nil
+		previous = result.Payload.Results[0]
+		if hostAddress(*previous.Address) == hostAddress(msg.IpAddress) {
+			vm.ManagementIPId = previous.ID
+			vm.n.cache.storeIP(previous)
+
+			//Only keep the DNS name in sync with the hostname
+			return vm.SyncDNSName(ctx, previous)
 		}
 
 		// 4. The management IP changed, so :
-		// - unlink the old ip and interface
 		// - set the new ip to the interface
-
-		oldIpUpdateParams := models.WritableIPAddress{
-			Address:            &msg.IpAddress,
-			AssignedObjectType: nil,
-			AssignedObjectID:   nil,
-		}
-
-		paramUnlinkOldIp := ipam.
-			NewIpamIPAddressesPartialUpdateParams().
-			WithID(ip.ID).
-			WithData(&oldIpUpdateParams).
-			WithTimeout(vm.n.GetDefaultTimeout())
-		_, err = vm.n.Client.Ipam.IpamIPAddressesPartialUpdate(paramUnlinkOldIp, nil)
-		if err != nil {
-			return fmt.Errorf("error unlinking management ip addresses of VM #%d: %w", vm.NetboxId, err)
-		}
-
-		// Set the ip to the new machine
-		newIpUpdateParam := vm.n.getIpAddress(msg.IpAddress)
-		newIpUpdateParam.AssignedObjectID = &vm.NetboxId
-		newIpUpdateParam.AssignedObjectType = &objectType
-
-		paramLinkNewIp := ipam.
-			NewIpamIPAddressesPartialUpdateParams().
-			WithID(ip.ID).
-			WithData(newIpUpdateParam).
-			WithTimeout(vm.n.GetDefaultTimeout())
-		_, err = vm.n.Client.Ipam.IpamIPAddressesPartialUpdate(paramLinkNewIp, nil)
-		if err != nil {
-			return fmt.Errorf("error linking ip with the new interface : %w", err)
-		}
-
-		util.Success("Successfully updated management ip addresses of VM #%d with new IP: %s", vm.NetboxId, msg.IpAddress)
-		return nil
+		// - unlink the old ip and interface
 	}
 
-	// 5. No existing IP, but verify that she doesn't already exist in the netbox
-	ipSearchParams := ipam.NewIpamIPAddressesListParams()
-	ipSearchParams.Q = &msg.IpAddress
-	result, err = vm.n.Client.Ipam.IpamIPAddressesList(ipSearchParams, nil)
+	// 5. Verify that the new IP doesn't already exist in the netbox
+	existing, err := vm.n.FindIPAddress(ctx, msg.IpAddress)
 	if err != nil {
-		return fmt.Errorf("error listing existing ip addresses: %w", err)
+		return err
 	}
 
-	existingIpCount := result.Payload.Count
-	newIpAddrId := int64(0)
-	if *existingIpCount == 0 {
+	if existing != nil {
+		err = vm.ClaimIP(ctx, existing, itf.ID)
+	} else {
 		util.Info("There is no IP registered in the netbox. Create him.")
-		var ipType = "virtualization.vminterface"
-		newIp := &ipam.IpamIPAddressesCreateParams{
-			Data: &models.WritableIPAddress{
-				Address:            &msg.IpAddress,
-				AssignedObjectID:   &itf.ID,
-				AssignedObjectType: &ipType,
-			},
-		}
-		r, err := vm.n.Client.Ipam.IpamIPAddressesCreate(newIp.WithTimeout(vm.n.GetDefaultTimeout()), nil)
-		if err != nil {
-			return fmt.Errorf("error creating ip address: %w", err)
+		var created *ipam.IpamIPAddressesCreateCreated
+		created, err = vm.CreateIP(ctx, vm.n, msg.IpAddress, models.IPAddressStatusValueActive, itf.ID, "virtualization.vminterface")
+		if err == nil {
+			vm.ManagementIPId = created.Payload.ID
+			vm.Journal(ctx, models.JournalEntryKindValueInfo, "Management IP %s created", msg.IpAddress)
 		}
+	}
 
-		newIpAddrId = r.Payload.ID
-	} else {
-		newIpAddrId = result.Payload.Results[0].ID
+	if err != nil || previous == nil {
+		return err
 	}
 
-	var ipType = "virtualization.vminterface"
+	err = vm.n.ReleaseIP(ctx, previous)
+	if err != nil {
+		return fmt.Errorf("error unlinking management ip addresses of VM #%d: %w", vm.NetboxId, err)
+	}
 
-	ip := vm.n.getIpAddress(msg.IpAddress)
-	ip.ID = newIpAddrId
-	ip.AssignedObjectID = &itf.ID
-	ip.AssignedObjectType = &ipType
+	util.Success("Successfully updated management ip addresses of VM #%d with new IP: %s", vm.NetboxId, msg.IpAddress)
+	vm.Journal(ctx, models.JournalEntryKindValueInfo, "Management IP changed from %s to %s", *previous.Address, msg.IpAddress)
+	return nil
+}
 
-	ifUpdateParam := &ipam.IpamIPAddressesPartialUpdateParams{
-		Data: ip,
+// SyncDNSName update the DNS name of the IP when the hostname or the domain changed
+func (vm *VirtualMachine) SyncDNSName(ctx context.Context, ip *models.IPAddress) error {
+	dnsName := vm.DNSName()
+	if dnsName == "" || ip.DNSName == dnsName {
+		return nil
 	}
-	_, err = vm.n.Client.Ipam.IpamIPAddressesPartialUpdate(ifUpdateParam.WithTimeout(vm.n.GetDefaultTimeout()), nil)
+
+	//Only the DNS name is sent, the status and address of the IP are left as they are
+	data := map[string]interface{}{"dns_name": dnsName}
+
+	err := vm.n.writeObject(ctx, "/ipam/ip-addresses/", ip.ID, data, nil)
+	vm.n.cache.forgetIP(*ip.Address)
 	if err != nil {
-		return fmt.Errorf("error updating ip address: %w", err)
+		return fmt.Errorf("error updating dns name of ip %s: %w", *ip.Address, err)
 	}
 
+	util.Success("Updated DNS name of %s to %s", *ip.Address, dnsName)
 	return nil
 }
 
-func (vm *VirtualMachine) Exists(hostname string, serial string) (bool, int64, error) {
+func (vm *VirtualMachine) Exists(ctx context.Context, hostname string, serial string) (bool, int64, error) {
 	if vm.NetboxId <= 0 && vm.n == nil {
 		return false, 0, nil
 	}
 
-	return vm.n.VmExists(hostname, serial)
+	return vm.n.VmExists(ctx, hostname, serial)
 }
@@ -0,0 +1,283 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// batchWriter coalesce the writes made on one endpoint within a short window into a single bulk request
+// Every caller waits for its batch and gets back its own object, or its own error
+type batchWriter struct {
+	window  time.Duration
+	size    int
+	timeout time.Duration
+	send    func(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error
+
+	mu      sync.Mutex
+	pending map[string]*batch
+}
+
+type batch struct {
+	method string
+	path   string
+	items  []*batchItem
+}
+
+type batchItem struct {
+	ctx    context.Context
+	data   map[string]interface{}
+	result chan batchResult
+}
+
+type batchResult struct {
+	object json.RawMessage
+	err    error
+}
+
+func newBatchWriter(window time.Duration, size int, timeout time.Duration, send func(context.Context, string, string, url.Values, interface{}, interface{}) error) *batchWriter {
+	if size < 1 {
+		size = 1
+	}
+
+	return &batchWriter{window: window, size: size, timeout: timeout, send: send, pending: map[string]*batch{}}
+}
+
+// submit queue the object for the next bulk request on the endpoint and wait for its result
+// A cancelled context stops the wait, but the object may still be written with its batch
+func (w *batchWriter) submit(ctx context.Context, method string, path string, data map[string]interface{}) (json.RawMessage, error) {
+	item := &batchItem{ctx: ctx, data: data, result: make(chan batchResult, 1)}
+	key := method + " " + path
+
+	w.mu.Lock()
+	b, ok := w.pending[key]
+	if !ok {
+		b = &batch{method: method, path: path}
+		w.pending[key] = b
+		time.AfterFunc(w.window, func() { w.flush(key, b) })
+	}
+
+	b.items = append(b.items, item)
+	if len(b.items) >= w.size {
+		delete(w.pending, key)
+		go w.write(b.method, b.path, b.items)
+	}
+	w.mu.Unlock()
+
+	select {
+	case res := <-item.result:
+		return res.object, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// flush send the batch once its window is over, unless it was already sent for being full
+func (w *batchWriter) flush(key string, b *batch) {
+	w.mu.Lock()
+	if w.pending[key] != b {
+		w.mu.Unlock()
+		return
+	}
+	delete(w.pending, key)
+	w.mu.Unlock()
+
+	w.write(b.method, b.path, b.items)
+}
+
+// write send the items as one bulk request and map the answer back to every item
+func (w *batchWriter) write(method string, path string, items []*batchItem) {
+	w.writeEntries(method, path, mergeItems(items))
+}
+
+// batchEntry is one object of a bulk request, answered to every item merged into it
+type batchEntry struct {
+	data  map[string]interface{}
+	items []*batchItem
+}
+
+func (e *batchEntry) resolve(res batchResult) {
+	for _, item := range e.items {
+		item.result <- res
+	}
+}
+
+// mergeItems combine the items updating the same object, the last written value of every field wins
+// Netbox would otherwise apply conflicting updates of one object in the same bulk request
+func mergeItems(items []*batchItem) []*batchEntry {
+	entries := make([]*batchEntry, 0, len(items))
+	byId := map[string]*batchEntry{}
+
+	for _, item := range items {
+		id, ok := item.data["id"]
+		if !ok {
+			entries = append(entries, &batchEntry{data: item.data, items: []*batchItem{item}})
+			continue
+		}
+
+		key := fmt.Sprint(id)
+		if entry, ok := byId[key]; ok {
+			for field, value := range item.data {
+				entry.data[field] = value
+			}
+			entry.items = append(entry.items, item)
+			continue
+		}
+
+		data := make(map[string]interface{}, len(item.data))
+		for field, value := range item.data {
+			data[field] = value
+		}
+
+		entry := &batchEntry{data: data, items: []*batchItem{item}}
+		byId[key] = entry
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func (w *batchWriter) writeEntries(method string, path string, entries []*batchEntry) {
+	if len(entries) == 1 {
+		w.writeOne(method, path, entries[0])
+		return
+	}
+
+	body := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		body = append(body, entry.data)
+	}
+
+	//The batch outlives the deliveries it serves, so it is bounded by the write timeout alone
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	var objects []json.RawMessage
+	err := w.send(ctx, method, path, nil, body, &objects)
+	if err == nil {
+		if len(objects) != len(entries) {
+			w.fail(entries, fmt.Errorf("bulk %s %s returned %d objects for %d items", method, path, len(objects), len(entries)))
+			return
+		}
+
+		util.Info("Wrote %d objects to %s in one bulk request", len(entries), path)
+		for i, entry := range entries {
+			entry.resolve(batchResult{object: objects[i]})
+		}
+		return
+	}
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code >= 500 {
+		w.fail(entries, err)
+		return
+	}
+
+	//Netbox validates bulk requests as a whole, errors are listed in the order of the items
+	var itemErrors []map[string]interface{}
+	if json.Unmarshal([]byte(apiErr.Body), &itemErrors) != nil || len(itemErrors) != len(entries) {
+		itemErrors = make([]map[string]interface{}, len(entries))
+	}
+
+	var valid []*batchEntry
+	for i, entry := range entries {
+		if len(itemErrors[i]) == 0 {
+			valid = append(valid, entry)
+			continue
+		}
+
+		content, _ := json.Marshal(itemErrors[i])
+		entry.resolve(batchResult{err: &APIError{Code: apiErr.Code, Body: string(content)}})
+	}
+
+	switch {
+	case len(valid) == len(entries):
+		//No item is blamed, find the failing one by sending them one by one
+		for _, entry := range entries {
+			w.writeOne(method, path, entry)
+		}
+
+	case len(valid) > 0:
+		//The whole request was rolled back, send again the items netbox accepted
+		w.writeEntries(method, path, valid)
+	}
+}
+
+// writeOne send the entry to the single object endpoint
+// An entry merged from several items is not bound to the context of any of them
+func (w *batchWriter) writeOne(method string, path string, entry *batchEntry) {
+	if id, ok := entry.data["id"]; ok {
+		path += fmt.Sprintf("%v/", id)
+	}
+
+	ctx := entry.items[0].ctx
+	if len(entry.items) > 1 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), w.timeout)
+		defer cancel()
+	}
+
+	var object json.RawMessage
+	err := w.send(ctx, method, path, nil, entry.data, &object)
+	entry.resolve(batchResult{object: object, err: err})
+}
+
+func (w *batchWriter) fail(entries []*batchEntry, err error) {
+	for _, entry := range entries {
+		entry.resolve(batchResult{err: err})
+	}
+}
+
+// toObject convert a netbox model to the generic form sent in bulk requests
+func toObject(data interface{}) (map[string]interface{}, error) {
+	if object, ok := data.(map[string]interface{}); ok {
+		return object, nil
+	}
+
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]interface{}
+	err = json.Unmarshal(content, &object)
+	return object, err
+}
+
+// writeObject create (id 0) or partially update an object of the endpoint, batching the write when enabled
+// The object netbox answered with is decoded into out, if not nil
+func (n *Netbox) writeObject(ctx context.Context, path string, id int64, data interface{}, out interface{}) error {
+	object, err := toObject(data)
+	if err != nil {
+		return err
+	}
+
+	method := http.MethodPost
+	if id != 0 {
+		method = http.MethodPatch
+		object["id"] = id
+	}
+
+	var result json.RawMessage
+	if n.batch != nil {
+		result, err = n.batch.submit(ctx, method, path, object)
+	} else {
+		if id != 0 {
+			path += strconv.FormatInt(id, 10) + "/"
+		}
+		err = n.rawRequest(ctx, method, path, nil, object, &result)
+	}
+
+	if err != nil || out == nil || len(result) == 0 {
+		return err
+	}
+
+	return json.Unmarshal(result, out)
+}
@@ -0,0 +1,166 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAnswer is the answer of the fake netbox to one request, echoing the body when err is nil
+type fakeAnswer struct {
+	err   error
+	count int
+}
+
+// fakeSend answer the requests in order and record them as "METHOD path size"
+type fakeSend struct {
+	answers []fakeAnswer
+	calls   []string
+}
+
+func (f *fakeSend) send(_ context.Context, method string, path string, _ url.Values, body interface{}, out interface{}) error {
+	size := 1
+	if list, ok := body.([]map[string]interface{}); ok {
+		size = len(list)
+	}
+	f.calls = append(f.calls, fmt.Sprintf("%s %s %d", method, path, size))
+
+	var answer fakeAnswer
+	if i := len(f.calls) - 1; i < len(f.answers) {
+		answer = f.answers[i]
+	}
+
+	if answer.err != nil {
+		return answer.err
+	}
+
+	//A wrong count answers with the first objects only
+	if list, ok := body.([]map[string]interface{}); ok && answer.count > 0 {
+		body = list[:answer.count]
+	}
+
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, out)
+}
+
+func TestBatchWriterWrite(t *testing.T) {
+	badRequest := func(body string) error { return &APIError{Code: 400, Body: body} }
+
+	tests := []struct {
+		name    string
+		method  string
+		items   []map[string]interface{}
+		answers []fakeAnswer
+		calls   []string
+		objects []string
+		errs    []string
+	}{
+		{
+			name:   "merged patches",
+			method: "PATCH",
+			items: []map[string]interface{}{
+				{"id": 1, "name": "a"},
+				{"id": 2, "name": "b"},
+				{"id": 1, "status": "active"},
+			},
+			calls:   []string{"PATCH /ipam/ip-addresses/ 2"},
+			objects: []string{`{"id":1,"name":"a","status":"active"}`, `{"id":2,"name":"b"}`, `{"id":1,"name":"a","status":"active"}`},
+			errs:    []string{"", "", ""},
+		},
+		{
+			name:   "per item errors",
+			method: "POST",
+			items: []map[string]interface{}{
+				{"name": "a"},
+				{"name": "b"},
+				{"name": "c"},
+			},
+			answers: []fakeAnswer{{err: badRequest(`[{}, {"name": ["invalid"]}, {}]`)}},
+			calls:   []string{"POST /ipam/ip-addresses/ 3", "POST /ipam/ip-addresses/ 2"},
+			objects: []string{`{"name":"a"}`, ``, `{"name":"c"}`},
+			errs:    []string{"", "invalid", ""},
+		},
+		{
+			name:   "unparsable error",
+			method: "POST",
+			items: []map[string]interface{}{
+				{"name": "a"},
+				{"name": "b"},
+			},
+			answers: []fakeAnswer{{err: badRequest("bad request")}, {}, {err: badRequest("name is invalid")}},
+			calls:   []string{"POST /ipam/ip-addresses/ 2", "POST /ipam/ip-addresses/ 1", "POST /ipam/ip-addresses/ 1"},
+			objects: []string{`{"name":"a"}`, ``},
+			errs:    []string{"", "name is invalid"},
+		},
+		{
+			name:   "server error",
+			method: "PATCH",
+			items: []map[string]interface{}{
+				{"id": 1, "name": "a"},
+				{"id": 2, "name": "b"},
+			},
+			answers: []fakeAnswer{{err: &APIError{Code: 503, Body: "unavailable"}}},
+			calls:   []string{"PATCH /ipam/ip-addresses/ 2"},
+			objects: []string{``, ``},
+			errs:    []string{"unavailable", "unavailable"},
+		},
+		{
+			name:   "wrong response count",
+			method: "POST",
+			items: []map[string]interface{}{
+				{"name": "a"},
+				{"name": "b"},
+			},
+			answers: []fakeAnswer{{count: 1}},
+			calls:   []string{"POST /ipam/ip-addresses/ 2"},
+			objects: []string{``, ``},
+			errs:    []string{"returned 1 objects for 2 items", "returned 1 objects for 2 items"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSend{answers: tt.answers}
+			w := newBatchWriter(time.Second, 10, time.Second, fake.send)
+
+			items := make([]*batchItem, 0, len(tt.items))
+			for _, data := range tt.items {
+				items = append(items, &batchItem{ctx: context.Background(), data: data, result: make(chan batchResult, 1)})
+			}
+
+			w.write(tt.method, "/ipam/ip-addresses/", items)
+
+			if strings.Join(fake.calls, "\n") != strings.Join(tt.calls, "\n") {
+				t.Errorf("calls = %q, want %q", fake.calls, tt.calls)
+			}
+
+			for i, item := range items {
+				var res batchResult
+				select {
+				case res = <-item.result:
+				default:
+					t.Fatalf("item %d got no result", i)
+				}
+
+				if string(res.object) != tt.objects[i] {
+					t.Errorf("item %d object = %s, want %s", i, res.object, tt.objects[i])
+				}
+
+				switch {
+				case tt.errs[i] == "" && res.err != nil:
+					t.Errorf("item %d error = %v, want none", i, res.err)
+				case tt.errs[i] != "" && (res.err == nil || !strings.Contains(res.err.Error(), tt.errs[i])):
+					t.Errorf("item %d error = %v, want %q", i, res.err, tt.errs[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/netbox-community/go-netbox/netbox/client/virtualization"
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	vmContentType    = "virtualization.virtualmachine"
+	customFieldsPath = "/extras/custom-fields/"
+)
+
+// Bootstrap create the netbox objects rh-api relies on when they are missing
+// It returns a description of every change made
+func (n *Netbox) Bootstrap(ctx context.Context) ([]string, error) {
+	if !n._isConnected {
+		return nil, errors.New("netbox is not connected")
+	}
+
+	var changes []string
+	report := func(changed bool, format string, args ...any) {
+		if changed {
+			changes = append(changes, fmt.Sprintf(format, args...))
+		}
+	}
+
+	changed, err := n.ensureCustomField(ctx, serialCustomField, CustomFieldText, "Serial")
+	if err != nil {
+		return changes, err
+	}
+	report(changed, "created custom field %s", serialCustomField)
+
+	for _, mapping := range n.CustomFieldMappings {
+		changed, err := n.ensureCustomField(ctx, mapping.Field, mapping.Type, mapping.Attribute)
+		if err != nil {
+			return changes, err
+		}
+		report(changed, "created custom field %s (%s)", mapping.Field, mapping.Type)
+	}
+
+	for _, name := range n.BootstrapTags {
+		slug := Slugify(name)
+		changed, err := n.ensureTag(ctx, name, slug)
+		if err != nil {
+			return changes, err
+		}
+		report(changed, "created tag %s", slug)
+	}
+
+	var typeId int64
+	for _, name := range n.managedClusterNames() {
+		exists, err := n.clusterExists(ctx, name)
+		if err != nil {
+			return changes, err
+		}
+
+		if exists {
+			continue
+		}
+
+		//The cluster type is only needed, and created, for missing clusters
+		if typeId == 0 {
+			var changed bool
+			typeId, changed, err = n.ensureClusterType(ctx, n.BootstrapClusterType)
+			if err != nil {
+				return changes, err
+			}
+			report(changed, "created cluster type %s", n.BootstrapClusterType)
+		}
+
+		if err := n.createCluster(ctx, name, typeId); err != nil {
+			return changes, err
+		}
+		report(true, "created cluster %s", name)
+	}
+
+	return changes, nil
+}
+
+// managedClusterNames list the clusters referenced by the configuration
+func (n *Netbox) managedClusterNames() []string {
+	var names []string
+	seen := map[string]bool{}
+
+	candidates := []string{n.Clusters.Default}
+	for _, rule := range n.Clusters.Rules {
+		candidates = append(candidates, rule.Value)
+	}
+
+	for _, name := range candidates {
+		//Numeric values reference existing clusters by ID
+		if _, err := strconv.ParseInt(name, 10, 64); name == "" || err == nil || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// ensureCustomField create the VM custom field when it is missing
+// Custom fields are read and written raw, netbox 4.0 renamed the attribute and the filter naming their models
+func (n *Netbox) ensureCustomField(ctx context.Context, name string, fieldType string, label string) (bool, error) {
+	caps := n.Capabilities()
+
+	query := url.Values{
+		"name":                  {name},
+		caps.objectTypeFilter(): {vmContentType},
+	}
+
+	var list struct {
+		Count int64 `json:"count"`
+	}
+	if err := n.rawRequest(ctx, http.MethodGet, customFieldsPath, query, nil, &list); err != nil {
+		return false, fmt.Errorf("error listing custom fields: %w", err)
+	}
+
+	if list.Count > 0 {
+		return false, nil
+	}
+
+	data := map[string]interface{}{
+		"name":                  name,
+		"label":                 label,
+		"type":                  fieldType,
+		"description":           "Managed by rh-api",
+		"filter_logic":          "exact",
+		caps.objectTypesField(): []string{vmContentType},
+	}
+
+	if err := n.rawRequest(ctx, http.MethodPost, customFieldsPath, nil, data, nil); err != nil {
+		return false, fmt.Errorf("error creating custom field %s: %w", name, err)
+	}
+
+	return true, nil
+}
+
+func (n *Netbox) ensureTag(ctx context.Context, name string, slug string) (bool, error) {
+	tag, err := n.findTag(ctx, name, slug)
+	if err != nil || tag != nil {
+		return false, err
+	}
+
+	if _, err := n.createTag(ctx, name, slug); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (n *Netbox) ensureClusterType(ctx context.Context, name string) (int64, bool, error) {
+	slug := Slugify(name)
+
+	params := virtualization.NewVirtualizationClusterTypesListParams().
+		WithSlug(&slug).
+		WithContext(ctx)
+	res, err := n.Client.Virtualization.VirtualizationClusterTypesList(params, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("error listing cluster types: %w", err)
+	}
+
+	if *res.Payload.Count > 0 {
+		return res.Payload.Results[0].ID, false, nil
+	}
+
+	createParams := virtualization.NewVirtualizationClusterTypesCreateParams().
+		WithData(&models.ClusterType{Name: &name, Slug: &slug}).
+		WithContext(ctx)
+	created, err := n.Client.Virtualization.VirtualizationClusterTypesCreate(createParams, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("error creating cluster type %s: %w", name, err)
+	}
+
+	return created.Payload.ID, true, nil
+}
+
+// clusterExists tells if at least one cluster matches the name, as looked up by fetchClusterId
+func (n *Netbox) clusterExists(ctx context.Context, name string) (bool, error) {
+	params := virtualization.NewVirtualizationClustersListParams().
+		WithNameIe(&name).
+		WithContext(ctx)
+	res, err := n.Client.Virtualization.VirtualizationClustersList(params, nil)
+	if err != nil {
+		return false, fmt.Errorf("error listing clusters: %w", err)
+	}
+
+	if *res.Payload.Count > 1 {
+		util.Warn("Found #%d clusters named %s, VMs can't be placed in it", *res.Payload.Count, name)
+	}
+
+	return *res.Payload.Count > 0, nil
+}
+
+func (n *Netbox) createCluster(ctx context.Context, name string, typeId int64) error {
+	createParams := virtualization.NewVirtualizationClustersCreateParams().
+		WithData(&models.WritableCluster{Name: &name, Type: &typeId, Status: models.ClusterStatusValueActive}).
+		WithContext(ctx)
+	_, err := n.Client.Virtualization.VirtualizationClustersCreate(createParams, nil)
+	if err != nil {
+		return fmt.Errorf("error creating cluster %s: %w", name, err)
+	}
+
+	return nil
+}
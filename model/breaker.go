@@ -0,0 +1,158 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/go-openapi/runtime"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling netbox while it is considered down
+var ErrCircuitOpen = errors.New("netbox circuit breaker is open")
+
+// Circuit breaker states
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker stop sending requests to netbox after threshold consecutive transport failures
+// Once open, a probe is sent every cooldown and the first answer closes the circuit again
+type circuitBreaker struct {
+	next      runtime.ClientTransport
+	threshold int
+	cooldown  time.Duration
+	probe     func() error
+
+	// changes receive true when the circuit opens and false when it closes, only the latest state is kept
+	changes chan bool
+
+	mu       sync.Mutex
+	state    int
+	failures int
+}
+
+func newCircuitBreaker(next runtime.ClientTransport, threshold int, cooldown time.Duration, probe func() error) *circuitBreaker {
+	return &circuitBreaker{
+		next:      next,
+		threshold: threshold,
+		cooldown:  cooldown,
+		probe:     probe,
+		changes:   make(chan bool, 1),
+	}
+}
+
+func (b *circuitBreaker) Submit(op *runtime.ClientOperation) (interface{}, error) {
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+
+	if state == circuitOpen {
+		return nil, ErrCircuitOpen
+	}
+
+	res, err := b.next.Submit(op)
+
+	//Requests abandoned or timed out by their caller say nothing about netbox
+	if err != nil && op.Context != nil && op.Context.Err() != nil {
+		return res, err
+	}
+
+	b.report(err)
+	return res, err
+}
+
+// report update the state with the outcome of a request
+func (b *circuitBreaker) report(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !isTransportFailure(err) {
+		b.failures = 0
+		if b.state == circuitHalfOpen {
+			util.Success("Netbox is reachable again, closing circuit breaker")
+			b.state = circuitClosed
+			b.notify(false)
+		}
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == circuitHalfOpen:
+		b.state = circuitOpen
+
+	case b.state == circuitClosed && b.failures >= b.threshold:
+		util.Warn("Opening circuit breaker after %d consecutive netbox failures: %s", b.failures, err)
+		b.state = circuitOpen
+		b.notify(true)
+		go b.recover()
+	}
+}
+
+// recover probe netbox every cooldown until the circuit is closed
+func (b *circuitBreaker) recover() {
+	for {
+		time.Sleep(b.cooldown)
+
+		b.mu.Lock()
+		if b.state == circuitOpen {
+			b.state = circuitHalfOpen
+		}
+		b.mu.Unlock()
+
+		err := b.probe()
+
+		b.mu.Lock()
+		closed := b.state == circuitClosed
+		b.mu.Unlock()
+
+		if closed {
+			return
+		}
+
+		util.Warn("Netbox is still unavailable: %s", err)
+	}
+}
+
+func (b *circuitBreaker) notify(open bool) {
+	select {
+	case <-b.changes:
+	default:
+	}
+
+	b.changes <- open
+}
+
+// isTransportFailure tells if err means netbox is unreachable or broken, rather than refusing the request
+func isTransportFailure(err error) bool {
+	//Requests abandoned by their caller or still waiting for the limiter say nothing about netbox
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, errThrottled) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code >= 500
+	}
+
+	var answered interface{ IsServerError() bool }
+	if errors.As(err, &answered) {
+		return answered.IsServerError()
+	}
+
+	return true
+}
+
+// CircuitChanges receive true when netbox becomes unavailable and false when it is back
+// It returns nil when the circuit breaker is disabled
+func (n *Netbox) CircuitChanges() <-chan bool {
+	if n.breaker == nil {
+		return nil
+	}
+
+	return n.breaker.changes
+}
@@ -0,0 +1,131 @@
+package model
+
+import (
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type ttlEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache is a map whose entries expire after ttl, a zero ttl disables it
+type ttlCache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]ttlEntry[V]
+}
+
+func newTTLCache[V any](ttl time.Duration) *ttlCache[V] {
+	return &ttlCache[V]{ttl: ttl, entries: map[string]ttlEntry[V]{}}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+
+		var zero V
+		return zero, false
+	}
+
+	return entry.value, true
+}
+
+func (c *ttlCache[V]) set(key string, value V) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = ttlEntry[V]{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *ttlCache[V]) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+func (c *ttlCache[V]) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]ttlEntry[V]{}
+}
+
+// lookupCache hold the netbox objects read while processing heartbeats
+// Only reads fill it, writes invalidate the entries they touch
+type lookupCache struct {
+	vms        *ttlCache[int64]
+	interfaces *ttlCache[*models.VMInterface]
+	ips        *ttlCache[*models.IPAddress]
+}
+
+func newLookupCache(ttl time.Duration) *lookupCache {
+	return &lookupCache{
+		vms:        newTTLCache[int64](ttl),
+		interfaces: newTTLCache[*models.VMInterface](ttl),
+		ips:        newTTLCache[*models.IPAddress](ttl),
+	}
+}
+
+// findVM return the ID of the VM with the given serial or hostname
+func (c *lookupCache) findVM(hostname string, serial string) (int64, bool) {
+	if serial != "" {
+		if id, ok := c.vms.get("serial:" + serial); ok {
+			return id, true
+		}
+	}
+
+	return c.vms.get("name:" + hostname)
+}
+
+func (c *lookupCache) storeVM(v *models.VirtualMachineWithConfigContext) {
+	c.vms.set("name:"+*v.Name, v.ID)
+	if serial := vmSerial(v); serial != "" {
+		c.vms.set("serial:"+serial, v.ID)
+	}
+}
+
+func (c *lookupCache) forgetVM(hostname string, serial string) {
+	c.vms.delete("name:" + hostname)
+	c.vms.delete("serial:" + serial)
+}
+
+// managementInterface return the management interface of the VM
+func (c *lookupCache) managementInterface(vmId int64) (*models.VMInterface, bool) {
+	return c.interfaces.get(strconv.FormatInt(vmId, 10))
+}
+
+func (c *lookupCache) storeManagementInterface(vmId int64, itf *models.VMInterface) {
+	c.interfaces.set(strconv.FormatInt(vmId, 10), itf)
+}
+
+func (c *lookupCache) ip(address string) (*models.IPAddress, bool) {
+	return c.ips.get(hostAddress(address))
+}
+
+func (c *lookupCache) storeIP(ip *models.IPAddress) {
+	c.ips.set(hostAddress(*ip.Address), ip)
+}
+
+func (c *lookupCache) forgetIP(address string) {
+	c.ips.delete(hostAddress(address))
+}
+
+// purge drop every entry, e.g. before comparing the registry with netbox
+func (c *lookupCache) purge() {
+	c.vms.purge()
+	c.interfaces.purge()
+	c.ips.purge()
+}
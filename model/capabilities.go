@@ -0,0 +1,106 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Capabilities lists the netbox features which differ between versions
+type Capabilities struct {
+	// VirtualDisks tells if VMs have virtual disks, netbox then computes their disk size (netbox >= 3.7)
+	VirtualDisks bool
+
+	// DiskMegabytes tells if disk sizes are in MB instead of GB (netbox >= 4.0)
+	DiskMegabytes bool
+
+	// ObjectTypes tells if custom fields list the models they apply to in object_types instead of content_types (netbox >= 4.0)
+	ObjectTypes bool
+
+	// ObjectTypeFilters tells if the models are filtered with object_type instead of content_types (netbox >= 4.0)
+	ObjectTypeFilters bool
+
+	// PrimaryIPGuarded tells if netbox refuses to move an IP away from the VM using it as primary IP (netbox >= 3.5)
+	PrimaryIPGuarded bool
+}
+
+// capabilitiesFor return the capabilities of a netbox version, e.g. "3.7.5"
+// Unknown versions are handled as netbox 3.x, the API the go-netbox client was generated from
+func capabilitiesFor(version string) Capabilities {
+	major, minor, ok := parseVersion(version)
+	if !ok {
+		return Capabilities{}
+	}
+
+	atLeast := func(m int, n int) bool {
+		return major > m || major == m && minor >= n
+	}
+
+	return Capabilities{
+		VirtualDisks:      atLeast(3, 7),
+		DiskMegabytes:     atLeast(4, 0),
+		ObjectTypes:       atLeast(4, 0),
+		ObjectTypeFilters: atLeast(4, 0),
+		PrimaryIPGuarded:  atLeast(3, 5),
+	}
+}
+
+// parseVersion read the major and minor numbers of a netbox version, e.g. "v4.1.3-Docker-3.0.2"
+func parseVersion(version string) (int, int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	//The minor number may carry a suffix, e.g. "7-beta1"
+	digits := parts[1]
+	if i := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = digits[:i]
+	}
+
+	minor, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return major, minor, true
+}
+
+// diskSize convert a size reported in GB to the netbox unit
+func (c Capabilities) diskSize(gb int64) int64 {
+	if c.DiskMegabytes {
+		return gb * 1000
+	}
+
+	return gb
+}
+
+// objectTypesField return the name of the custom field attribute listing the models it applies to
+func (c Capabilities) objectTypesField() string {
+	if c.ObjectTypes {
+		return "object_types"
+	}
+
+	return "content_types"
+}
+
+// objectTypeFilter return the name of the filter matching custom fields by model
+func (c Capabilities) objectTypeFilter() string {
+	if c.ObjectTypeFilters {
+		return "object_type"
+	}
+
+	return "content_types"
+}
+
+// Capabilities return the capabilities of the netbox version read by the last validation
+func (n *Netbox) Capabilities() Capabilities {
+	n.server.mu.RLock()
+	defer n.server.mu.RUnlock()
+
+	return n.server.capabilities
+}
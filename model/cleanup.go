@@ -0,0 +1,171 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/netbox-community/go-netbox/netbox/client/ipam"
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"net/http"
+)
+
+// Policies applied to management IPs released by rh-api
+const (
+	ReleasedIPKeep      = "keep"
+	ReleasedIPDeprecate = "deprecate"
+	ReleasedIPDelete    = "delete"
+)
+
+// ReleaseIP detach a former management IP from its interface and apply the release policy
+// Released IPs are tagged, so CleanupReleasedIPs can find them later
+func (n *Netbox) ReleaseIP(ctx context.Context, ip *models.IPAddress) error {
+	tags, err := n.EnsureTags(ctx, []string{n.ReleasedIPTag})
+	if err != nil {
+		return err
+	}
+
+	if n.Capabilities().PrimaryIPGuarded && ip.AssignedObjectID != nil &&
+		ip.AssignedObjectType != nil && *ip.AssignedObjectType == "virtualization.vminterface" {
+		owner, err := n.getInterfaceOwner(ctx, *ip.AssignedObjectID)
+		if err != nil {
+			return err
+		}
+
+		if err := n.clearPrimaryIP(ctx, ip, owner); err != nil {
+			return err
+		}
+	}
+
+	//The generated client omits nil fields, so the assignment is cleared through a raw request
+	//The DNS name is cleared too, the host must only be exported on its new address
+	data := map[string]interface{}{
+		"assigned_object_type": nil,
+		"assigned_object_id":   nil,
+		"tags":                 mergeTags(ip.Tags, tags),
+		"dns_name":             "",
+	}
+
+	err = n.writeObject(ctx, "/ipam/ip-addresses/", ip.ID, data, nil)
+	n.cache.forgetIP(*ip.Address)
+	if err != nil {
+		return err
+	}
+
+	return n.applyReleasePolicy(ctx, ip)
+}
+
+// applyReleasePolicy deprecate or delete a released IP, depending on the policy
+func (n *Netbox) applyReleasePolicy(ctx context.Context, ip *models.IPAddress) error {
+	switch n.ReleasedIPPolicy {
+	case ReleasedIPDeprecate:
+		if ip.Status != nil && ip.Status.Value != nil && *ip.Status.Value == models.IPAddressStatusValueDeprecated {
+			return nil
+		}
+
+		data := n.getIpAddress(*ip.Address)
+		data.Status = models.IPAddressStatusValueDeprecated
+
+		err := n.writeObject(ctx, "/ipam/ip-addresses/", ip.ID, data, nil)
+		n.cache.forgetIP(*ip.Address)
+		if err != nil {
+			return fmt.Errorf("error deprecating ip %s: %w", *ip.Address, err)
+		}
+
+		util.Success("Deprecated released IP %s", *ip.Address)
+
+	case ReleasedIPDelete:
+		params := ipam.NewIpamIPAddressesDeleteParams().
+			WithID(ip.ID).
+			WithContext(ctx)
+		_, err := n.Client.Ipam.IpamIPAddressesDelete(params, nil)
+		n.cache.forgetIP(*ip.Address)
+		if err != nil {
+			return fmt.Errorf("error deleting ip %s: %w", *ip.Address, err)
+		}
+
+		util.Success("Deleted released IP %s", *ip.Address)
+	}
+
+	return nil
+}
+
+// CleanupReleasedIPs apply the release policy to every unassigned IP released by rh-api
+// It returns the number of IPs processed, IPs already deprecated are left out
+func (n *Netbox) CleanupReleasedIPs(ctx context.Context) (int, error) {
+	if n.ReleasedIPPolicy == ReleasedIPKeep {
+		return 0, nil
+	}
+
+	if n.dryRun != nil {
+		//The cleanup must not mix its actions with the ones of a message
+		n.dryRun.session.Lock()
+		defer n.dryRun.session.Unlock()
+
+		n.dryRun.flush()
+		defer n.dryRun.flush()
+	}
+
+	slug := Slugify(n.ReleasedIPTag)
+	unassigned := "false"
+	limit := int64(0)
+
+	params := ipam.NewIpamIPAddressesListParams().
+		WithTag(&slug).
+		WithAssignedToInterface(&unassigned).
+		WithLimit(&limit).
+		WithContext(ctx)
+	if n.ReleasedIPPolicy == ReleasedIPDeprecate {
+		deprecated := models.IPAddressStatusValueDeprecated
+		params.SetStatusn(&deprecated)
+	}
+
+	res, err := n.Client.Ipam.IpamIPAddressesList(params, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error listing released ip addresses: %w", err)
+	}
+
+	count := 0
+	for _, listed := range res.Payload.Results {
+		//A heartbeat may have reclaimed the IP since it was listed
+		ip, err := n.getReleasedIP(ctx, listed.ID, slug)
+		if err != nil {
+			return count, err
+		}
+
+		if ip == nil {
+			util.Info("IP %s was reclaimed, leaving it", *listed.Address)
+			continue
+		}
+
+		if err := n.applyReleasePolicy(ctx, ip); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// getReleasedIP read the IP again, it returns nil when it is gone, assigned or no longer tagged as released
+func (n *Netbox) getReleasedIP(ctx context.Context, id int64, slug string) (*models.IPAddress, error) {
+	params := ipam.NewIpamIPAddressesReadParams().
+		WithID(id).
+		WithContext(ctx)
+	res, err := n.Client.Ipam.IpamIPAddressesRead(params, nil)
+	if err != nil {
+		var notFound *ipam.IpamIPAddressesReadDefault
+		if errors.As(err, &notFound) && notFound.Code() == http.StatusNotFound {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("error reading ip address #%d: %w", id, err)
+	}
+
+	ip := res.Payload
+	if _, tagged := withoutTag(ip.Tags, slug); !tagged || ip.AssignedObjectID != nil {
+		return nil, nil
+	}
+
+	return ip, nil
+}
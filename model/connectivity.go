@@ -0,0 +1,61 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// serverInfo hold what is known of the netbox instance, it is refreshed by every validation
+type serverInfo struct {
+	mu           sync.RWMutex
+	version      string
+	capabilities Capabilities
+}
+
+// permissionChecks are the endpoints rh-api must be allowed to read
+var permissionChecks = []string{
+	"/virtualization/virtual-machines/",
+	"/virtualization/interfaces/",
+	"/ipam/ip-addresses/",
+}
+
+// Validate check that netbox answers and that the token is accepted, then record the netbox version
+func (n *Netbox) Validate(ctx context.Context) error {
+	var status struct {
+		Version string `json:"netbox-version"`
+	}
+
+	if err := n.rawRequest(ctx, http.MethodGet, "/status/", nil, nil, &status); err != nil {
+		return fmt.Errorf("unable to reach netbox status endpoint: %w", err)
+	}
+
+	for _, path := range permissionChecks {
+		err := n.rawRequest(ctx, http.MethodGet, path, url.Values{"limit": {"1"}}, nil, nil)
+		if err != nil {
+			return fmt.Errorf("unable to read %s, check NETBOX_API_TOKEN permissions: %w", path, err)
+		}
+	}
+
+	n.server.mu.Lock()
+	defer n.server.mu.Unlock()
+
+	if status.Version != n.server.version {
+		n.server.capabilities = capabilitiesFor(status.Version)
+		util.Info("Connected to netbox %s (%+v)", status.Version, n.server.capabilities)
+	}
+	n.server.version = status.Version
+
+	return nil
+}
+
+// Version return the netbox version read by the last validation
+func (n *Netbox) Version() string {
+	n.server.mu.RLock()
+	defer n.server.mu.RUnlock()
+
+	return n.server.version
+}
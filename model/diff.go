@@ -0,0 +1,146 @@
+package model
+
+import (
+	"encoding/json"
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"sort"
+)
+
+// Diff compare the desired VM state with the current netbox one
+// It returns the partial update to send and the name of the fields it changes
+func (vm *VirtualMachine) Diff(current *models.VirtualMachineWithConfigContext) (models.WritableVirtualMachineWithConfigContext, []string) {
+	desired := vm.Get()
+	var changed []string
+
+	//Name is always sent, netbox requires it in the payload
+	patch := models.WritableVirtualMachineWithConfigContext{Name: desired.Name}
+
+	if current.Name == nil || *current.Name != *desired.Name {
+		changed = append(changed, "name")
+	}
+
+	if desired.Status != "" && (current.Status == nil || current.Status.Value == nil || *current.Status.Value != desired.Status) {
+		patch.Status = desired.Status
+		changed = append(changed, "status")
+	}
+
+	var currentCluster, currentSite, currentTenant, currentRole, currentPlatform *int64
+	if current.Cluster != nil {
+		currentCluster = &current.Cluster.ID
+	}
+	if current.Site != nil {
+		currentSite = &current.Site.ID
+	}
+	if current.Tenant != nil {
+		currentTenant = &current.Tenant.ID
+	}
+	if current.Role != nil {
+		currentRole = &current.Role.ID
+	}
+	if current.Platform != nil {
+		currentPlatform = &current.Platform.ID
+	}
+
+	diffInt(&patch.Cluster, desired.Cluster, currentCluster, "cluster", &changed)
+	diffInt(&patch.Site, desired.Site, currentSite, "site", &changed)
+	diffInt(&patch.Tenant, desired.Tenant, currentTenant, "tenant", &changed)
+	diffInt(&patch.Role, desired.Role, currentRole, "role", &changed)
+	diffInt(&patch.Platform, desired.Platform, currentPlatform, "platform", &changed)
+	diffInt(&patch.Memory, desired.Memory, current.Memory, "memory", &changed)
+	diffInt(&patch.Disk, desired.Disk, current.Disk, "disk", &changed)
+
+	if desired.Vcpus != nil && (current.Vcpus == nil || *current.Vcpus != *desired.Vcpus) {
+		patch.Vcpus = desired.Vcpus
+		changed = append(changed, "vcpus")
+	}
+
+	if desired.Tags != nil && !sameTags(desired.Tags, current.Tags) {
+		patch.Tags = desired.Tags
+		changed = append(changed, "tags")
+	}
+
+	if fields := diffCustomFields(desired.CustomFields, current.CustomFields, vm.n.customFieldTypes()); len(fields) > 0 {
+		patch.CustomFields = fields
+		changed = append(changed, "custom_fields")
+	}
+
+	return patch, changed
+}
+
+// diffInt set the patch field when the desired value is set and differs from the current one
+func diffInt(patch **int64, desired *int64, current *int64, name string, changed *[]string) {
+	if desired == nil || (current != nil && *current == *desired) {
+		return
+	}
+
+	*patch = desired
+	*changed = append(*changed, name)
+}
+
+func sameTags(a []*models.NestedTag, b []*models.NestedTag) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	slugs := func(tags []*models.NestedTag) []string {
+		s := make([]string, 0, len(tags))
+		for _, t := range tags {
+			if t.Slug != nil {
+				s = append(s, *t.Slug)
+			}
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	sa, sb := slugs(a), slugs(b)
+	for i := range sa {
+		if sa[i] != sb[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// diffCustomFields return the desired custom fields whose value differs from the current one
+// types gives the type of the mapped fields, the values of the other ones are compared as is
+func diffCustomFields(desired interface{}, current interface{}, types map[string]string) map[string]interface{} {
+	desiredFields, _ := desired.(map[string]interface{})
+	currentFields, _ := current.(map[string]interface{})
+	fields := map[string]interface{}{}
+
+	for k, v := range desiredFields {
+		if !sameCustomField(types[k], v, currentFields[k]) {
+			fields[k] = v
+		}
+	}
+
+	return fields
+}
+
+// sameCustomField compare two values of a custom field once normalised for its type
+// e.g. netbox may answer a datetime with +00:00 where Z was sent
+func sameCustomField(fieldType string, want interface{}, got interface{}) bool {
+	switch fieldType {
+	case CustomFieldDate, CustomFieldDatetime:
+		wantTime, wantErr := parseTime(want)
+		gotTime, gotErr := parseTime(got)
+		if wantErr == nil && gotErr == nil {
+			return wantTime.Equal(gotTime)
+		}
+
+	case CustomFieldInteger, CustomFieldDecimal, CustomFieldBoolean:
+		if v, err := coerceCustomField(want, fieldType); err == nil {
+			want = v
+		}
+		if v, err := coerceCustomField(got, fieldType); err == nil {
+			got = v
+		}
+	}
+
+	//Other values are compared through their JSON encoding, as netbox returns numbers as float64
+	wantJSON, _ := json.Marshal(want)
+	gotJSON, _ := json.Marshal(got)
+	return string(wantJSON) == string(gotJSON)
+}
@@ -0,0 +1,203 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PlannedAction is a netbox write skipped by the dry-run mode
+type PlannedAction struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Body   interface{} `json:"body,omitempty"`
+}
+
+// dryRunTransport forwards reads to netbox and records every other request instead of sending it
+// Recorded writes are answered with a fake object carrying a negative ID, so callers can go on
+type dryRunTransport struct {
+	next runtime.ClientTransport
+
+	// session serialize message processing, so recorded actions can be attributed to one message
+	session sync.Mutex
+
+	mu      sync.Mutex
+	actions []PlannedAction
+	nextId  int64
+}
+
+func newDryRunTransport(next runtime.ClientTransport) *dryRunTransport {
+	return &dryRunTransport{next: next, nextId: -1000}
+}
+
+func (t *dryRunTransport) Submit(op *runtime.ClientOperation) (interface{}, error) {
+	if op.Method == http.MethodGet {
+		return t.next.Submit(op)
+	}
+
+	req := &recordingRequest{method: op.Method, path: op.PathPattern, query: url.Values{}, header: http.Header{}}
+	if op.Params != nil {
+		if err := op.Params.WriteToRequest(req, strfmt.Default); err != nil {
+			return nil, err
+		}
+	}
+
+	action := PlannedAction{Method: op.Method, Path: req.GetPath(), Body: req.body}
+	t.record(action)
+
+	//Allocations are answered with the address netbox would have picked
+	if op.Method == http.MethodPost && strings.HasSuffix(op.PathPattern, "/available-ips/") {
+		listOp := *op
+		listOp.Method = http.MethodGet
+		listOp.Params = runtime.ClientRequestWriterFunc(func(r runtime.ClientRequest, _ strfmt.Registry) error {
+			for k, v := range req.pathParams {
+				if err := r.SetPathParam(k, v); err != nil {
+					return err
+				}
+			}
+			return r.SetQueryParam("limit", "1")
+		})
+		listOp.Reader = runtime.ClientResponseReaderFunc(func(resp runtime.ClientResponse, consumer runtime.Consumer) (interface{}, error) {
+			var available []struct {
+				Address string `json:"address"`
+			}
+			if err := consumer.Consume(resp.Body(), &available); err != nil {
+				return nil, err
+			}
+
+			allocated := make([]map[string]interface{}, 0, len(available))
+			for _, a := range available {
+				allocated = append(allocated, map[string]interface{}{"id": t.fakeId(), "address": a.Address})
+			}
+
+			body, _ := json.Marshal(allocated)
+			return op.Reader.ReadResponse(&fakeResponse{code: http.StatusCreated, body: body}, consumer)
+		})
+
+		return t.next.Submit(&listOp)
+	}
+
+	code, body := http.StatusOK, []byte(`{}`)
+	switch op.Method {
+	case http.MethodPost:
+		code = http.StatusCreated
+		body, _ = json.Marshal(map[string]int64{"id": t.fakeId()})
+	case http.MethodDelete:
+		code, body = http.StatusNoContent, nil
+	}
+
+	return op.Reader.ReadResponse(&fakeResponse{code: code, body: body}, runtime.JSONConsumer())
+}
+
+func (t *dryRunTransport) record(action PlannedAction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	body, _ := json.Marshal(action.Body)
+	util.Info("[DRY-RUN] %s %s %s", action.Method, action.Path, body)
+	t.actions = append(t.actions, action)
+}
+
+func (t *dryRunTransport) fakeId() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextId--
+	return t.nextId
+}
+
+// flush return the actions recorded since the previous call
+func (t *dryRunTransport) flush() []PlannedAction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	actions := t.actions
+	t.actions = nil
+	return actions
+}
+
+// recordingRequest capture what a generated client operation would have sent
+type recordingRequest struct {
+	method     string
+	path       string
+	pathParams map[string]string
+	query      url.Values
+	header     http.Header
+	body       interface{}
+}
+
+func (r *recordingRequest) SetHeaderParam(name string, values ...string) error {
+	r.header[http.CanonicalHeaderKey(name)] = values
+	return nil
+}
+
+func (r *recordingRequest) GetHeaderParams() http.Header { return r.header }
+
+func (r *recordingRequest) SetQueryParam(name string, values ...string) error {
+	r.query[name] = values
+	return nil
+}
+
+func (r *recordingRequest) SetFormParam(string, ...string) error { return nil }
+
+func (r *recordingRequest) SetPathParam(name string, value string) error {
+	if r.pathParams == nil {
+		r.pathParams = map[string]string{}
+	}
+	r.pathParams[name] = value
+	return nil
+}
+
+func (r *recordingRequest) GetQueryParams() url.Values { return r.query }
+
+func (r *recordingRequest) SetFileParam(string, ...runtime.NamedReadCloser) error { return nil }
+
+func (r *recordingRequest) SetBodyParam(body interface{}) error {
+	r.body = body
+	return nil
+}
+
+func (r *recordingRequest) SetTimeout(time.Duration) error { return nil }
+
+func (r *recordingRequest) GetMethod() string { return r.method }
+
+func (r *recordingRequest) GetPath() string {
+	path := r.path
+	for k, v := range r.pathParams {
+		path = strings.ReplaceAll(path, "{"+k+"}", v)
+	}
+	return path
+}
+
+func (r *recordingRequest) GetBody() []byte {
+	body, _ := json.Marshal(r.body)
+	return body
+}
+
+func (r *recordingRequest) GetBodyParam() interface{} { return r.body }
+
+func (r *recordingRequest) GetFileParam() map[string][]runtime.NamedReadCloser { return nil }
+
+// fakeResponse is handed to the generated readers in place of a netbox answer
+type fakeResponse struct {
+	code int
+	body []byte
+}
+
+func (r *fakeResponse) Code() int { return r.code }
+
+func (r *fakeResponse) Message() string { return http.StatusText(r.code) }
+
+func (r *fakeResponse) GetHeader(string) string { return "" }
+
+func (r *fakeResponse) GetHeaders(string) []string { return nil }
+
+func (r *fakeResponse) Body() io.ReadCloser { return io.NopCloser(bytes.NewReader(r.body)) }
@@ -0,0 +1,304 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/netbox-community/go-netbox/netbox/client/ipam"
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// FindIPAddress return the netbox IP object matching the address, or nil if there is none
+// IPs are matched on their host address, whatever their mask length
+func (n *Netbox) FindIPAddress(ctx context.Context, address string) (*models.IPAddress, error) {
+	if ip, ok := n.cache.ip(address); ok {
+		return ip, nil
+	}
+
+	host := hostAddress(address)
+	params := ipam.NewIpamIPAddressesListParams().
+		WithAddress(&host).
+		WithContext(ctx)
+	res, err := n.Client.Ipam.IpamIPAddressesList(params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing ip addresses: %w", err)
+	}
+
+	if *res.Payload.Count == 0 {
+		return nil, nil
+	}
+
+	if *res.Payload.Count > 1 {
+		util.Warn("Found #%d IPs matching %s, using the first one", *res.Payload.Count, address)
+	}
+
+	n.cache.storeIP(res.Payload.Results[0])
+	return res.Payload.Results[0], nil
+}
+
+// GetPrefix return the netbox prefix object matching exactly the given CIDR
+func (n *Netbox) GetPrefix(ctx context.Context, prefix string) (*models.Prefix, error) {
+	params := ipam.NewIpamPrefixesListParams().
+		WithPrefix(&prefix).
+		WithContext(ctx)
+	res, err := n.Client.Ipam.IpamPrefixesList(params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing prefixes: %w", err)
+	}
+
+	if *res.Payload.Count == 0 {
+		return nil, fmt.Errorf("prefix %s does not exist in netbox", prefix)
+	}
+
+	return res.Payload.Results[0], nil
+}
+
+// getAllocationPrefixId resolve the configured allocation prefix to its netbox ID
+// Either a numeric ID or a CIDR can be configured
+func (n *Netbox) getAllocationPrefixId(ctx context.Context) (int64, error) {
+	if n.allocationPrefixId > 0 {
+		return n.allocationPrefixId, nil
+	}
+
+	if n.AllocationPrefix == "" {
+		return 0, errors.New("no allocation prefix configured (NETBOX_ALLOCATION_PREFIX)")
+	}
+
+	if id, err := strconv.ParseInt(n.AllocationPrefix, 10, 64); err == nil {
+		n.allocationPrefixId = id
+		return id, nil
+	}
+
+	prefix, err := n.GetPrefix(ctx, n.AllocationPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	n.allocationPrefixId = prefix.ID
+	return prefix.ID, nil
+}
+
+// AllocateIP reserve the next available IP of the allocation prefix
+func (n *Netbox) AllocateIP(ctx context.Context) (*models.IPAddress, error) {
+	prefixId, err := n.getAllocationPrefixId(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve allocation prefix: %w", err)
+	}
+
+	//A single object is answered with a single object, which the generated client fails to decode as a list
+	var allocated []*models.IPAddress
+	path := fmt.Sprintf("/ipam/prefixes/%d/available-ips/", prefixId)
+	err = n.rawRequest(ctx, http.MethodPost, path, nil, []*models.WritableAvailableIP{{}}, &allocated)
+	if err != nil {
+		return nil, fmt.Errorf("error allocating ip address from prefix #%d: %w", prefixId, err)
+	}
+
+	if len(allocated) == 0 {
+		return nil, fmt.Errorf("prefix #%d has no available ip address", prefixId)
+	}
+
+	ip := allocated[0]
+	util.Success("Allocated IP %s from prefix #%d", *ip.Address, prefixId)
+
+	return ip, nil
+}
+
+// resolveAllocatedIP fill the message address for agents asking for one
+// A VM already owning a management IP keeps it, so retried messages don't exhaust the prefix
+func (n *Netbox) resolveAllocatedIP(ctx context.Context, msg *Message, exist bool, vmId int64) error {
+	if exist {
+		vm := NewVM(n, *msg)
+		vm.NetboxId = vmId
+
+		ip, err := vm.GetManagementIP(ctx)
+		if err != nil {
+			return err
+		}
+
+		if ip != nil {
+			util.Info("VM %s already owns management IP %s", msg.Hostname, *ip.Address)
+			msg.IpAddress = *ip.Address
+			return nil
+		}
+	}
+
+	ip, err := n.AllocateIP(ctx)
+	if err != nil {
+		return err
+	}
+
+	msg.IpAddress = *ip.Address
+	return nil
+}
+
+// Policies applied to management IPs which are not inside an allowed prefix
+const (
+	PrefixPolicyOff    = "off"
+	PrefixPolicyFlag   = "flag"
+	PrefixPolicyReject = "reject"
+)
+
+// hostAddress return the address without its mask length, in its canonical form
+func hostAddress(address string) string {
+	host, _, _ := strings.Cut(address, "/")
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return host
+}
+
+// GetEnclosingPrefix return the most specific netbox prefix containing the address, or nil if there is none
+func (n *Netbox) GetEnclosingPrefix(ctx context.Context, address string) (*models.Prefix, error) {
+	host := hostAddress(address)
+	ordering := "-mask_length"
+
+	params := ipam.NewIpamPrefixesListParams().
+		WithContains(&host).
+		WithOrdering(&ordering).
+		WithContext(ctx)
+	res, err := n.Client.Ipam.IpamPrefixesList(params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing prefixes containing %s: %w", host, err)
+	}
+
+	var best *models.Prefix
+	bestLength := -1
+	for _, p := range res.Payload.Results {
+		_, network, err := net.ParseCIDR(*p.Prefix)
+		if err != nil {
+			continue
+		}
+
+		if length, _ := network.Mask.Size(); length > bestLength {
+			best, bestLength = p, length
+		}
+	}
+
+	return best, nil
+}
+
+// isAllowedAddress tells if the address is inside one of the configured allowed prefixes
+// Every address is allowed when no prefix is configured
+func (n *Netbox) isAllowedAddress(address string) bool {
+	if len(n.AllowedPrefixes) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(hostAddress(address))
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range n.AllowedPrefixes {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckIPAddress apply the prefix policy to the address reported by the agent
+// It returns the enclosing prefix, nil when there is none or when the policy is off
+func (n *Netbox) CheckIPAddress(ctx context.Context, address string) (*models.Prefix, error) {
+	if n.PrefixPolicy == PrefixPolicyOff {
+		return nil, nil
+	}
+
+	if address == "" {
+		return nil, permanent(errors.New("no management address reported"))
+	}
+
+	prefix, err := n.GetEnclosingPrefix(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var problem string
+	if prefix == nil {
+		problem = fmt.Sprintf("address %s is not inside any netbox prefix", address)
+	} else if !n.isAllowedAddress(address) {
+		problem = fmt.Sprintf("address %s is not inside an allowed prefix", address)
+	}
+
+	if problem != "" {
+		if n.PrefixPolicy == PrefixPolicyReject {
+			return nil, permanent(errors.New(problem))
+		}
+
+		util.Warn("%s, registering it anyway", problem)
+	}
+
+	return prefix, nil
+}
+
+// checkPrefixPolicy tells if the configured prefix policy is known
+func (n *Netbox) checkPrefixPolicy() error {
+	switch n.PrefixPolicy {
+	case PrefixPolicyOff, PrefixPolicyFlag, PrefixPolicyReject:
+		return nil
+	}
+
+	return fmt.Errorf("unknown NETBOX_PREFIX_POLICY %s", n.PrefixPolicy)
+}
+
+// withPrefixLength replace the mask length of the address with the prefix one
+func withPrefixLength(address string, prefix string) string {
+	parts := strings.Split(prefix, "/")
+	if len(parts) != 2 {
+		return address
+	}
+
+	return hostAddress(address) + "/" + parts[1]
+}
+
+// applyPrefixDefaults copy the mask length, VRF and tenant of the enclosing prefix onto the IP to create
+// prefix is the one returned by CheckIPAddress
+func (n *Netbox) applyPrefixDefaults(ip *models.WritableIPAddress, prefix *models.Prefix) {
+	if n.PrefixPolicy == PrefixPolicyOff {
+		return
+	}
+
+	if prefix == nil {
+		ip.Description = "Outside of any known prefix"
+		return
+	}
+
+	if !n.isAllowedAddress(*ip.Address) {
+		ip.Description = "Outside of allowed prefixes"
+	} else {
+		address := withPrefixLength(*ip.Address, *prefix.Prefix)
+		ip.Address = &address
+	}
+
+	if prefix.Vrf != nil {
+		ip.Vrf = &prefix.Vrf.ID
+	}
+
+	if prefix.Tenant != nil {
+		ip.Tenant = &prefix.Tenant.ID
+	}
+}
+
+// parseAllowedPrefixes read the list of CIDRs management IPs must belong to
+func parseAllowedPrefixes(prefixes []string) []*net.IPNet {
+	var networks []*net.IPNet
+
+	for _, p := range prefixes {
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			util.Warn("Ignoring invalid allowed prefix %s: %s", p, err)
+			continue
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks
+}
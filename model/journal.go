@@ -0,0 +1,43 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/netbox-community/go-netbox/netbox/client/extras"
+	"github.com/netbox-community/go-netbox/netbox/models"
+)
+
+// Journal append an entry describing an automated change to the VM journal
+// Journal failures are only logged, they must not fail the change itself
+func (vm *VirtualMachine) Journal(ctx context.Context, kind string, format string, args ...any) {
+	if !vm.n.Journal || (vm.NetboxId <= 0 && !vm.n.DryRun) {
+		return
+	}
+
+	comments := fmt.Sprintf(format, args...) + "\n\n" + vm.source
+	objectType := vmContentType
+
+	params := extras.NewExtrasJournalEntriesCreateParams().
+		WithData(&models.WritableJournalEntry{
+			AssignedObjectID:   &vm.NetboxId,
+			AssignedObjectType: &objectType,
+			Kind:               kind,
+			Comments:           &comments,
+		}).
+		WithContext(ctx)
+	_, err := vm.n.Client.Extras.ExtrasJournalEntriesCreate(params, nil)
+	if err != nil {
+		util.Warn("Unable to add journal entry to VM #%d: %s", vm.NetboxId, err)
+	}
+}
+
+// journalSource describe the message at the origin of the changes
+func journalSource(msg Message) string {
+	id := msg.MessageId
+	if id == "" {
+		id = "without ID"
+	}
+
+	return fmt.Sprintf("_rh-api: message %s from agent %s_", id, msg.Hostname)
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"context"
+	"github.com/KittenConnect/rh-api/util"
+	"path"
+	"strings"
+	"sync"
+)
+
+// idCache remember the netbox IDs of objects resolved by name or slug
+// Those objects are rarely changed, so entries never expire
+type idCache struct {
+	mu  sync.Mutex
+	ids map[string]int64
+}
+
+func newIdCache() *idCache {
+	return &idCache{ids: map[string]int64{}}
+}
+
+func (c *idCache) get(key string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.ids[key]
+	return id, ok
+}
+
+func (c *idCache) set(key string, id int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ids[key] = id
+}
+
+// resolve return the cached ID of key, or call fetch and cache its result
+func (c *idCache) resolve(ctx context.Context, key string, fetch func(context.Context, string) (int64, error)) (int64, error) {
+	if id, ok := c.get(key); ok {
+		return id, nil
+	}
+
+	id, err := fetch(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	c.set(key, id)
+	return id, nil
+}
+
+// HostRule assign a value to every host whose name matches Pattern
+type HostRule struct {
+	Pattern string
+	Value   string
+}
+
+// parseHostRules read an ordered list of pattern=value rules from the environment
+// Patterns use shell globbing, e.g. "web-*=production"
+func parseHostRules(key string) []HostRule {
+	var rules []HostRule
+
+	for _, entry := range util.GetEnvList(key) {
+		pattern, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			util.Warn("Ignoring invalid rule %q in %s, expected pattern=value", entry, key)
+			continue
+		}
+
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			util.Warn("Ignoring invalid pattern %q in %s: %s", pattern, key, err)
+			continue
+		}
+
+		rules = append(rules, HostRule{Pattern: pattern, Value: strings.TrimSpace(value)})
+	}
+
+	return rules
+}
+
+// matchHostRules return the value of the first rule matching the hostname
+func matchHostRules(rules []HostRule, hostname string) (string, bool) {
+	for _, rule := range rules {
+		if ok, _ := path.Match(rule.Pattern, hostname); ok {
+			return rule.Value, true
+		}
+	}
+
+	return "", false
+}
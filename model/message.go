@@ -6,9 +6,46 @@ import (
 )
 
 type Message struct {
+	// MessageId identifies the message across retries, it defaults to the AMQP message ID
+	MessageId string `json:"message_id,omitempty" binding:"optional"`
+
 	Hostname  string `json:"hostname"`
 	IpAddress string `json:"ipaddress"`
-	serial    string `json:"serial" binding:"optional"`
+	Serial    string `json:"serial,omitempty" binding:"optional"`
+
+	// AllocateIP asks rh-api to pick the address from the allocation prefix
+	// The allocated address is returned in IpAddress
+	AllocateIP bool `json:"allocate_ip,omitempty" binding:"optional"`
+
+	// Status is the netbox status of the VM, e.g. decommissioning when the agent shuts down, it is left untouched when empty
+	Status string `json:"status,omitempty" binding:"optional"`
+
+	// Cluster is the name or ID of the netbox cluster hosting the VM
+	Cluster string `json:"cluster,omitempty" binding:"optional"`
+
+	// Site, Tenant, Role and Platform are netbox slugs
+	Site     string `json:"site,omitempty" binding:"optional"`
+	Tenant   string `json:"tenant,omitempty" binding:"optional"`
+	Role     string `json:"role,omitempty" binding:"optional"`
+	Platform string `json:"platform,omitempty" binding:"optional"`
+
+	// Hardware resources, Memory is in MB and Disk in GB
+	Vcpus  float64       `json:"vcpus,omitempty" binding:"optional"`
+	Memory int64         `json:"memory,omitempty" binding:"optional"`
+	Disk   int64         `json:"disk,omitempty" binding:"optional"`
+	Disks  []VirtualDisk `json:"disks,omitempty" binding:"optional"`
+
+	// Tags are netbox tag names, created if they don't exist
+	Tags []string `json:"tags,omitempty" binding:"optional"`
+
+	// Attributes are free-form facts mapped to custom fields by NETBOX_CUSTOM_FIELDS
+	Attributes map[string]interface{} `json:"attributes,omitempty" binding:"optional"`
+
+	// PreviousIPOwner is the VM the management IP was taken from, it is only set in result messages
+	PreviousIPOwner *IPOwner `json:"previous_ip_owner,omitempty"`
+
+	// PlannedActions lists the writes skipped in dry-run mode, it is only set in result messages
+	PlannedActions []PlannedAction `json:"planned_actions,omitempty"`
 
 	//Make following json field optional with default 0
 	FailCount int `json:"failcount" binding:"optional"`
@@ -21,9 +58,9 @@ func (m *Message) parseSerial() string {
 }
 
 func (m *Message) GetSerial() string {
-	if m.serial == "" {
-		m.serial = m.parseSerial()
+	if m.Serial == "" {
+		m.Serial = m.parseSerial()
 	}
 
-	return m.serial
+	return m.Serial
 }
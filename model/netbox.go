@@ -5,33 +5,182 @@ import (
 	"errors"
 	"fmt"
 	"github.com/KittenConnect/rh-api/util"
-	"github.com/netbox-community/go-netbox/netbox"
+	"github.com/go-openapi/strfmt"
 	"github.com/netbox-community/go-netbox/netbox/client"
-	"github.com/netbox-community/go-netbox/netbox/client/ipam"
-	"github.com/netbox-community/go-netbox/netbox/client/virtualization"
 	"github.com/netbox-community/go-netbox/netbox/models"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 )
 
+// ErrPermanent is matched by the errors retrying the message can't fix, e.g. an address refused by a policy
+var ErrPermanent = errors.New("permanent error")
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string        { return e.err.Error() }
+func (e permanentError) Unwrap() error        { return e.err }
+func (e permanentError) Is(target error) bool { return target == ErrPermanent }
+
+// permanent mark the error as one retrying the message can't fix
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
 // Netbox structure
 // For internal use ONLY !
 // To get an instance, call NewNetbox method
 type Netbox struct {
-	ctx context.Context
-
 	Client *client.NetBoxAPI
 
+	// ReadTimeout and WriteTimeout bound every netbox request, within the deadline of the caller context
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// server describes the netbox instance, as read by Validate
+	server *serverInfo
+
+	// DryRun performs every read but only records writes, see PlannedAction
+	DryRun bool
+	dryRun *dryRunTransport
+
+	// AllocationPrefix is the prefix (CIDR or netbox ID) used to allocate IPs for agents asking for one
+	AllocationPrefix   string
+	allocationPrefixId int64
+
+	// PrefixPolicy tells what to do with management IPs outside AllowedPrefixes (off, flag or reject)
+	PrefixPolicy    string
+	AllowedPrefixes []*net.IPNet
+
+	// DNSDomain is appended to the hostname to build the management IP DNS name
+	// ClusterDNSDomains overrides it per cluster name or ID
+	DNSDomain         string
+	ClusterDNSDomains map[string]string
+
+	// Clusters, Sites, Tenants, Roles and Platforms are picked from the message,
+	// hostname rules (NETBOX_<X>_RULES) or defaults (NETBOX_DEFAULT_<X>)
+	Clusters  hostAttribute
+	Sites     hostAttribute
+	Tenants   hostAttribute
+	Roles     hostAttribute
+	Platforms hostAttribute
+
+	// TagMode tells if message tags are added to the VM ones (additive) or replace them (authoritative)
+	TagMode  string
+	TagColor string
+	tags     *tagCache
+
+	// CustomFieldMappings copy message attributes to VM custom fields
+	CustomFieldMappings []CustomFieldMapping
+
+	// Journal enables journal entries on VMs for every automated change
+	Journal bool
+
+	// IPConflictPolicy tells if a management IP owned by another VM can be taken (steal, refuse or steal-if-offline)
+	// IPOwnerStaleAfter is how long an owner must have been silent to be considered gone by steal-if-offline
+	IPConflictPolicy  string
+	IPOwnerStaleAfter time.Duration
+
+	// ReleasedIPPolicy tells what happens to former management IPs (keep, deprecate or delete)
+	ReleasedIPPolicy string
+	ReleasedIPTag    string
+
+	// Registry holds the last applied message of every host, ReconcileMode tells if drift is corrected
+	Registry      *Registry
+	ReconcileMode string
+
+	// StateMaxAge forces a full sync of unchanged hosts once their state is that old
+	StateMaxAge time.Duration
+
+	// BootstrapTags and BootstrapClusterType are the tags and the type of missing clusters created by Bootstrap
+	BootstrapTags        []string
+	BootstrapClusterType string
+
+	// cache holds VM, interface and IP lookups for NETBOX_CACHE_TTL
+	cache *lookupCache
+
+	// BatchWindow is how long VM and IP writes wait for others to share a bulk request, 0 disables batching
+	BatchWindow time.Duration
+	BatchSize   int
+	batch       *batchWriter
+
+	// RateLimit caps the requests per second sent to netbox (with RateBurst), MaxInFlight the concurrent ones, 0 disables them
+	RateLimit   float64
+	RateBurst   int
+	MaxInFlight int
+
+	// BreakerThreshold consecutive transport failures open the circuit breaker for BreakerCooldown, 0 disables it
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	breaker          *circuitBreaker
+
 	_isConnected bool
 }
 
 // NewNetbox return a fresh Netbox object
 func NewNetbox() Netbox {
 	nbx := Netbox{
-		ctx:    context.Background(),
 		Client: nil,
 
+		ReadTimeout:  util.GetEnvDuration("NETBOX_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout: util.GetEnvDuration("NETBOX_WRITE_TIMEOUT", 30*time.Second),
+		DryRun:       util.GetEnvBool("NETBOX_DRY_RUN", false),
+
+		AllocationPrefix: os.Getenv("NETBOX_ALLOCATION_PREFIX"),
+
+		PrefixPolicy:    util.GetEnv("NETBOX_PREFIX_POLICY", PrefixPolicyOff),
+		AllowedPrefixes: parseAllowedPrefixes(util.GetEnvList("NETBOX_ALLOWED_PREFIXES")),
+
+		DNSDomain:         os.Getenv("NETBOX_DNS_DOMAIN"),
+		ClusterDNSDomains: util.GetEnvMap("NETBOX_DNS_CLUSTER_DOMAINS"),
+
+		Clusters:  newHostAttribute("CLUSTER"),
+		Sites:     newHostAttribute("SITE"),
+		Tenants:   newHostAttribute("TENANT"),
+		Roles:     newHostAttribute("ROLE"),
+		Platforms: newHostAttribute("PLATFORM"),
+
+		TagMode:  util.GetEnv("NETBOX_TAG_MODE", TagModeAdditive),
+		TagColor: util.GetEnv("NETBOX_TAG_COLOR", "9e9e9e"),
+		tags:     newTagCache(),
+
+		server: &serverInfo{},
+
+		CustomFieldMappings: parseCustomFieldMappings("NETBOX_CUSTOM_FIELDS"),
+
+		Journal: util.GetEnvBool("NETBOX_JOURNAL", true),
+
+		IPConflictPolicy:  util.GetEnv("NETBOX_IP_CONFLICT_POLICY", IPConflictRefuse),
+		IPOwnerStaleAfter: util.GetEnvDuration("NETBOX_IP_OWNER_STALE_AFTER", 24*time.Hour),
+
+		ReleasedIPPolicy: util.GetEnv("NETBOX_RELEASED_IP_POLICY", ReleasedIPKeep),
+		ReleasedIPTag:    util.GetEnv("NETBOX_RELEASED_IP_TAG", "rh-api-released"),
+
+		Registry:      NewRegistry(),
+		ReconcileMode: util.GetEnv("NETBOX_RECONCILE_MODE", ReconcileModeReport),
+		StateMaxAge:   util.GetEnvDuration("NETBOX_STATE_MAX_AGE", time.Hour),
+
+		BootstrapTags:        util.GetEnvList("NETBOX_BOOTSTRAP_TAGS"),
+		BootstrapClusterType: util.GetEnv("NETBOX_BOOTSTRAP_CLUSTER_TYPE", "rh-api"),
+
+		cache: newLookupCache(util.GetEnvDuration("NETBOX_CACHE_TTL", 5*time.Minute)),
+
+		BatchWindow: util.GetEnvDuration("NETBOX_BATCH_WINDOW", 0),
+		BatchSize:   util.GetEnvInt("NETBOX_BATCH_SIZE", 50),
+
+		RateLimit:   util.GetEnvFloat("NETBOX_RATE_LIMIT", 0),
+		RateBurst:   util.GetEnvInt("NETBOX_RATE_BURST", 1),
+		MaxInFlight: util.GetEnvInt("NETBOX_MAX_IN_FLIGHT", 0),
+
+		BreakerThreshold: util.GetEnvInt("NETBOX_BREAKER_THRESHOLD", 5),
+		BreakerCooldown:  util.GetEnvDuration("NETBOX_BREAKER_COOLDOWN", 30*time.Second),
+
 		_isConnected: false,
 	}
 
@@ -42,21 +191,63 @@ func (n *Netbox) IsConnected() bool {
 	return n._isConnected
 }
 
-func (n *Netbox) Connect() error {
+func (n *Netbox) Connect(ctx context.Context) error {
 	if n._isConnected {
 		return nil
 	}
 
-	n.Client = netbox.NewNetboxWithAPIKey(os.Getenv("NETBOX_API_URL"), os.Getenv("NETBOX_API_TOKEN"))
+	host := os.Getenv("NETBOX_API_URL")
+	if host == "" {
+		return errors.New("NETBOX_API_URL is not set")
+	}
+
+	if err := n.checkPrefixPolicy(); err != nil {
+		return err
+	}
+
+	transport, err := newAPITransport(host, os.Getenv("NETBOX_API_TOKEN"), max(n.ReadTimeout, n.WriteTimeout))
+	if err != nil {
+		return err
+	}
+
+	//The deadline starts once the request leaves the limiter, waiting for a slot doesn't use up the timeout
+	transport = &deadlineTransport{next: transport, read: n.ReadTimeout, write: n.WriteTimeout}
+
+	if n.RateLimit > 0 || n.MaxInFlight > 0 {
+		util.Info("Limiting netbox requests to %g/s (burst %d) and %d in flight", n.RateLimit, n.RateBurst, n.MaxInFlight)
+		transport = newLimitedTransport(transport, n.RateLimit, n.RateBurst, n.MaxInFlight)
+	}
+
+	if n.BreakerThreshold > 0 {
+		//The probe is bounded by the read timeout of deadlineTransport, a timeout of its own would not be counted
+		n.breaker = newCircuitBreaker(transport, n.BreakerThreshold, n.BreakerCooldown, func() error {
+			return n.rawRequest(context.Background(), http.MethodGet, "/status/", nil, nil, nil)
+		})
+		transport = n.breaker
+	}
+
+	if n.DryRun {
+		util.Warn("Dry-run mode enabled, no change will be written to netbox")
+		n.dryRun = newDryRunTransport(transport)
+		transport = n.dryRun
+	}
+
+	n.Client = client.New(transport, strfmt.Default)
+
+	//Recorded writes are answered one by one, they can't be batched
+	if n.BatchWindow > 0 && !n.DryRun {
+		n.batch = newBatchWriter(n.BatchWindow, n.BatchSize, n.WriteTimeout, n.rawRequest)
+	}
+
+	if err := n.Validate(ctx); err != nil {
+		return err
+	}
+
 	n._isConnected = true
 
 	return nil
 }
 
-func (n *Netbox) GetDefaultTimeout() time.Duration {
-	return time.Duration(30) * time.Second
-}
-
 func (n *Netbox) getIpAddress(ip string) *models.WritableIPAddress {
 	return &models.WritableIPAddress{
 		Address: &ip,
@@ -64,196 +255,300 @@ func (n *Netbox) getIpAddress(ip string) *models.WritableIPAddress {
 	}
 }
 
-func (n *Netbox) CreateVM(msg Message) error {
+func (n *Netbox) CreateVM(ctx context.Context, msg *Message, prefix *models.Prefix) (*VirtualMachine, error) {
 	if !n._isConnected {
-		return errors.New("netbox is not connected")
+		return nil, errors.New("netbox is not connected")
+	}
+
+	vm := NewVM(n, *msg)
+	vm.Prefix = prefix
+
+	cluster, err := n.GetCluster(ctx, *msg)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving cluster: %w", err)
+	}
+	vm.Cluster = cluster
+
+	vm.Placement, err = n.GetPlacement(ctx, *msg)
+	if err != nil {
+		return nil, err
+	}
+
+	vm.Tags, err = n.EnsureTags(ctx, msg.Tags)
+	if err != nil {
+		return nil, err
 	}
 
-	vm := NewVM(n, msg)
-	res, err := vm.Create(msg)
+	res, err := vm.Create(ctx, *msg)
 	if err != nil {
 		if res != nil && res.Payload != nil {
-			return fmt.Errorf("error creating virtual machine: %w \n\t%s", err, res.Error())
+			return nil, fmt.Errorf("error creating virtual machine: %w \n\t%s", err, res.Error())
 		}
 
-		return fmt.Errorf("error creating virtual machine: %w", err)
+		return nil, fmt.Errorf("error creating virtual machine: %w", err)
 	}
 
 	util.Success("Created machine ID: %d", res.Payload.ID)
 	vm.NetboxId = res.Payload.ID
+	vm.Journal(ctx, models.JournalEntryKindValueInfo, "Virtual machine %s created", vm.Name)
+
+	err = vm.SyncVirtualDisks(ctx, msg.Disks)
+	if err != nil {
+		return nil, err
+	}
 
 	//Create management interface
-	r, err := vm.CreateInterface("mgmt")
+	r, err := vm.CreateInterface(ctx, "mgmt")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var (
 		ifId       = r.Payload.ID
 		objectType = "virtualization.vminterface"
 	)
+	vm.ManagementInterfaceId = ifId
 
 	//Verify if ip already exists
-	ipAlreadyExist := &ipam.IpamIPAddressesListParams{
-		Address: &msg.IpAddress,
-	}
-	req, err := n.Client.Ipam.
-		IpamIPAddressesList(ipAlreadyExist.WithTimeout(n.GetDefaultTimeout()), nil)
+	existing, err := n.FindIPAddress(ctx, msg.IpAddress)
 	if err != nil {
-		return fmt.Errorf("error checking ip addresses existance : %w", err)
+		return nil, fmt.Errorf("error checking ip addresses existance : %w", err)
 	}
 
-	util.Info("Found #%d IPs in %v", *req.Payload.Count, *req)
 	//We don't have that ip registered on netbox, so let's create him
-	if *req.Payload.Count == 0 {
+	if existing == nil {
 		//Set ip to the interface
-		createdIP, err := vm.CreateIP(n, msg.IpAddress, models.IPAddressStatusValueActive, ifId, objectType)
+		createdIP, err := vm.CreateIP(ctx, n, msg.IpAddress, models.IPAddressStatusValueActive, ifId, objectType)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		util.Success("\tSuccessfully created vm management ip: %s", strconv.FormatInt(createdIP.Payload.ID, 10))
-	} else if *req.Payload.Count == 1 {
-		ip := req.Payload.Results[0]
-
-		linkedInterfaceId := ip.AssignedObjectID
-
-		//Si l'ip n'est pas liée à une interface
-		//On l'assigne à l'interface de la machine et zou
-		if linkedInterfaceId == nil {
-			return vm.UpdateInterfaceIP(msg.IpAddress, ifId, objectType)
-		}
-
-		//Sinon on vérifie si la VM possède d'autres IP sur l'interface de management
-		interfaceId := *linkedInterfaceId
-		vmInterfaceParam := virtualization.
-			NewVirtualizationInterfacesReadParams().
-			WithID(interfaceId).
-			WithTimeout(n.GetDefaultTimeout())
-
-		vmInterfaceResult, err := n.Client.Virtualization.VirtualizationInterfacesRead(vmInterfaceParam, nil)
+		vm.ManagementIPId = createdIP.Payload.ID
+		vm.Journal(ctx, models.JournalEntryKindValueInfo, "Management IP %s created", msg.IpAddress)
+	} else {
+		err = vm.ClaimIP(ctx, existing, ifId)
+		msg.PreviousIPOwner = vm.PreviousIPOwner
 		if err != nil {
-			return fmt.Errorf("error reading virtual machine interface: %w", err)
+			return nil, err
 		}
+	}
 
-		vmID := strconv.FormatInt(vmInterfaceResult.Payload.VirtualMachine.ID, 10)
+	return vm, nil
+}
 
-		mgmtInterfaceName := "mgmt"
-		nestedVmParams := &virtualization.VirtualizationInterfacesListParams{
-			Name:             &mgmtInterfaceName,
-			VirtualMachineID: &vmID,
-		}
-		nestedVmInterfaces, err := n.Client.Virtualization.
-			VirtualizationInterfacesList(nestedVmParams.WithTimeout(n.GetDefaultTimeout()), nil)
-		if err != nil {
-			return fmt.Errorf("error listing virtual machine interfaces: %w", err)
-		}
+func (n *Netbox) UpdateVM(ctx context.Context, id int64, msg *Message, prefix *models.Prefix) (*VirtualMachine, error) {
+	vm := NewVM(n, *msg)
+	vm.NetboxId = id
+	vm.Prefix = prefix
 
-		mgmtInterface := nestedVmInterfaces.Payload.Results[0]
-		if mgmtInterface.CountIpaddresses == 1 {
-			//L'interface possède d'autres IPs
-			//Du coup, on prend l'ip en question
-			util.Info("Remove the link ...")
-			err := vm.UpdateInterfaceIP(msg.IpAddress, ifId, objectType)
-			if err != nil {
-				return err
-			}
-			util.Success("IP changed of interface")
-
-			return nil
-		} else {
-			//Sinon on laisse l'ip sur la VM
-			util.Info("L'IP %s reste sur l'interface n°%d", msg.IpAddress, mgmtInterface.ID)
-		}
+	cluster, err := n.GetCluster(ctx, *msg)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving cluster: %w", err)
+	}
+	vm.Cluster = cluster
 
-		util.Warn("Trying to using existing IP on VM interface #%s", strconv.FormatInt(mgmtInterface.ID, 10))
+	vm.Placement, err = n.GetPlacement(ctx, *msg)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
-}
+	current, err := vm.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-func (n *Netbox) UpdateVM(id int64, msg Message) error {
-	vm := NewVM(n, msg)
-	vm.NetboxId = id
+	err = vm.SetTags(ctx, msg.Tags, current)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := vm.Create(msg)
+	err = vm.Update(ctx, current)
+	if err != nil {
+		return nil, err
+	}
 
-	err = vm.Update()
+	err = vm.SyncVirtualDisks(ctx, msg.Disks)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//Update management IP
-	return vm.UpdateManagementIP(msg)
+	err = vm.UpdateManagementIP(ctx, *msg)
+	msg.PreviousIPOwner = vm.PreviousIPOwner
+
+	return vm, err
+}
+
+// CreateOrUpdateVM register the VM described by the message in netbox
+// The message is updated in place with the data rh-api resolved (e.g. an allocated IP)
+func (n *Netbox) CreateOrUpdateVM(ctx context.Context, msg *Message) error {
+	return n.createOrUpdateVM(ctx, msg, false)
 }
 
-func (n *Netbox) CreateOrUpdateVM(msg Message) error {
+// createOrUpdateVM register the VM, force bypass the unchanged payload short-circuit
+func (n *Netbox) createOrUpdateVM(ctx context.Context, msg *Message, force bool) error {
 	if !n._isConnected {
 		return errors.New("netbox is not connected")
 	}
 
+	if n.dryRun != nil {
+		n.dryRun.session.Lock()
+		defer n.dryRun.session.Unlock()
+
+		n.dryRun.flush()
+		defer func() {
+			msg.PlannedActions = n.dryRun.flush()
+		}()
+	}
+
 	var vmId int64
 	var err error
 
+	if msg.Status != "" && !slices.Contains(vmStatuses, msg.Status) {
+		return permanent(fmt.Errorf("unknown VM status %s", msg.Status))
+	}
+
+	serial := msg.GetSerial()
+	key := hostKey(*msg)
+	hash := PayloadHash(*msg)
+
+	// Skip heartbeats identical to the last applied one, a full sync still happens every StateMaxAge
+	state, known := n.Registry.Get(key)
+	if known && !force && state.PayloadHash == hash && time.Since(state.AppliedAt) < n.StateMaxAge {
+		util.Info("VM %s is unchanged since %s, skipping", msg.Hostname, state.AppliedAt.Format(time.RFC3339))
+		if !n.DryRun {
+			n.Registry.Touch(key)
+		}
+		if msg.IpAddress == "" {
+			msg.IpAddress = state.Message.IpAddress
+		}
+
+		return nil
+	}
+
 	// Call netbox API with specific serial, then update his settings accordingly
-	//exist := contains(MachinesSerials, msg.Hostname) //TODO
-	//if !exist {
-	//If the vm don't exist in memory, fetch his details, if she exists in netbox
-	exist, vmId, err := n.VmExists(msg.Hostname, msg.GetSerial())
+	exist := known && state.VmId > 0
+	vmId = state.VmId
+	if !exist {
+		//If the vm don't exist in memory, fetch his details, if she exists in netbox
+		exist, vmId, err = n.VmExists(ctx, msg.Hostname, serial)
+		if err != nil {
+			return fmt.Errorf("error checking if VM exists: %w", err)
+		}
+	}
+
+	if msg.AllocateIP && msg.IpAddress == "" {
+		err = n.resolveAllocatedIP(ctx, msg, exist, vmId)
+		if err != nil {
+			return fmt.Errorf("unable to allocate IP: %w", err)
+		}
+	}
+
+	prefix, err := n.CheckIPAddress(ctx, msg.IpAddress)
 	if err != nil {
-		return fmt.Errorf("error checking if VM exists: %w", err)
+		return fmt.Errorf("refusing management IP: %w", err)
 	}
 
+	var vm *VirtualMachine
+
 	//Create VM if she doesn't exists in netbox
 	if !exist {
-		err = n.CreateVM(msg)
+		vm, err = n.CreateVM(ctx, msg, prefix)
 
 		if err != nil {
 			return fmt.Errorf("unable to create VM: %w", err)
 		}
 	} else {
-		err = n.UpdateVM(vmId, msg)
+		vm, err = n.UpdateVM(ctx, vmId, msg, prefix)
 		if err != nil {
+			//The VM may have been deleted since it was stored, look it up again next time
+			n.Registry.Forget(key)
+			n.cache.forgetVM(msg.Hostname, serial)
 			return fmt.Errorf("unable to update VM: %w", err)
 		}
 
 		//util.Success("VM updated successfully")
 	}
 
+	if !n.DryRun {
+		n.Registry.Record(HostState{
+			Message:     *msg,
+			VmId:        vm.NetboxId,
+			InterfaceId: vm.ManagementInterfaceId,
+			IpId:        vm.ManagementIPId,
+			PayloadHash: hash,
+			AppliedAt:   time.Now(),
+			LastSeen:    time.Now(),
+		})
+	}
+
 	return nil
 }
 
-func (n *Netbox) VmExists(hostname string, serial string) (bool, int64, error) {
-	//Check if the vm exist in netbox
-	req := virtualization.
-		NewVirtualizationVirtualMachinesListParams().
-		WithTimeout(n.GetDefaultTimeout())
-	res, err := n.Client.Virtualization.VirtualizationVirtualMachinesList(req, nil)
-	if err != nil {
-		return false, 0, fmt.Errorf("unable to get list of machines from netbox: %w", err)
+func (n *Netbox) VmExists(ctx context.Context, hostname string, serial string) (bool, int64, error) {
+	if id, ok := n.cache.findVM(hostname, serial); ok {
+		return true, id, nil
 	}
 
-	for _, v := range res.Payload.Results {
-		if *v.Name == hostname {
+	//Check if the vm exist in netbox, the serial first as the hostname may have changed
+	if serial != "" {
+		v, err := n.lookupVM(ctx, url.Values{"cf_" + serialCustomField: {serial}}, func(v *models.VirtualMachineWithConfigContext) bool {
+			return vmSerial(v) == serial
+		})
+		if err != nil {
+			return false, 0, fmt.Errorf("unable to get list of machines from netbox: %w", err)
+		}
+
+		if v != nil {
+			n.cache.storeVM(v)
 			return true, v.ID, nil
 		}
+	}
 
-		var cf = v.CustomFields.(map[string]interface{})
-		var serial = ""
+	v, err := n.lookupVM(ctx, url.Values{"name": {hostname}}, func(v *models.VirtualMachineWithConfigContext) bool {
+		return v.Name != nil && *v.Name == hostname
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("unable to get list of machines from netbox: %w", err)
+	}
 
-		for k, v := range cf {
-			switch c := v.(type) {
-			case string:
-				if k == "kc_serial_" {
-					serial = c
-				}
-			}
-		}
+	if v != nil {
+		n.cache.storeVM(v)
+		return true, v.ID, nil
+	}
 
-		if serial != "" {
-			return true, v.ID, nil
+	return false, 0, nil
+}
+
+// lookupVM return the VM matching the filter and accepted by match, or nil if there is none
+// Text custom field filters may be loose (icontains), every result is checked against match
+func (n *Netbox) lookupVM(ctx context.Context, query url.Values, match func(*models.VirtualMachineWithConfigContext) bool) (*models.VirtualMachineWithConfigContext, error) {
+	var list struct {
+		Results []*models.VirtualMachineWithConfigContext `json:"results"`
+	}
+
+	//Custom field filters are not covered by the generated client, limit=0 returns the largest page netbox allows
+	query.Set("limit", "0")
+	err := n.rawRequest(ctx, http.MethodGet, "/virtualization/virtual-machines/", query, nil, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*models.VirtualMachineWithConfigContext
+	for _, v := range list.Results {
+		if match(v) {
+			found = append(found, v)
 		}
 	}
 
-	return false, 0, nil
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	if len(found) > 1 {
+		util.Warn("Found #%d VMs matching %s, using the first one", len(found), query.Encode())
+	}
+
+	return found[0], nil
 }
@@ -0,0 +1,219 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/netbox-community/go-netbox/netbox/client/virtualization"
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"time"
+)
+
+// Policies applied when the reported management IP is already assigned to another VM
+const (
+	IPConflictSteal          = "steal"
+	IPConflictRefuse         = "refuse"
+	IPConflictStealIfOffline = "steal-if-offline"
+)
+
+// IPOwner is the VM an IP address was assigned to before rh-api moved it
+type IPOwner struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// ClaimIP assign an existing IP to the interface, applying the conflict policy when another VM owns it
+func (vm *VirtualMachine) ClaimIP(ctx context.Context, ip *models.IPAddress, ifId int64) error {
+	vm.ManagementIPId = ip.ID
+
+	if ip.AssignedObjectID != nil && *ip.AssignedObjectID == ifId {
+		return vm.SyncDNSName(ctx, ip)
+	}
+
+	if ip.AssignedObjectID == nil {
+		err := vm.assignIP(ctx, ip, ifId)
+		if err != nil {
+			return err
+		}
+
+		vm.Journal(ctx, models.JournalEntryKindValueInfo, "Existing management IP %s assigned", *ip.Address)
+		return nil
+	}
+
+	if ip.AssignedObjectType == nil || *ip.AssignedObjectType != "virtualization.vminterface" {
+		objectType := "unknown object"
+		if ip.AssignedObjectType != nil {
+			objectType = *ip.AssignedObjectType
+		}
+
+		return permanent(fmt.Errorf("ip %s is assigned to a %s, refusing to move it", *ip.Address, objectType))
+	}
+
+	owner, err := vm.n.getInterfaceOwner(ctx, *ip.AssignedObjectID)
+	if err != nil {
+		return err
+	}
+
+	if owner.ID == vm.NetboxId {
+		return vm.assignIP(ctx, ip, ifId)
+	}
+
+	if err := vm.n.checkIPConflict(*ip.Address, owner); err != nil {
+		return err
+	}
+
+	if err := vm.n.clearPrimaryIP(ctx, ip, owner); err != nil {
+		return err
+	}
+
+	err = vm.assignIP(ctx, ip, ifId)
+	if err != nil {
+		return err
+	}
+
+	util.Warn("Moved management IP %s from VM %s (#%d) to VM %s", *ip.Address, owner.Name, owner.ID, vm.Name)
+	vm.PreviousIPOwner = &IPOwner{ID: owner.ID, Name: *owner.Name}
+	vm.Journal(ctx, models.JournalEntryKindValueWarning, "Management IP %s moved from VM %s (#%d)", *ip.Address, *owner.Name, owner.ID)
+
+	previous := &VirtualMachine{n: vm.n, NetboxId: owner.ID, source: vm.source}
+	previous.Journal(ctx, models.JournalEntryKindValueWarning, "Management IP %s moved to VM %s (#%d)", *ip.Address, vm.Name, vm.NetboxId)
+
+	return nil
+}
+
+// checkIPConflict tells if the policy allows taking the address from its owner
+// Refusals are permanent, retrying the message won't change the policy
+func (n *Netbox) checkIPConflict(address string, owner *models.VirtualMachineWithConfigContext) error {
+	switch n.IPConflictPolicy {
+	case IPConflictSteal:
+		return nil
+
+	case IPConflictStealIfOffline:
+		status := ""
+		if owner.Status != nil && owner.Status.Value != nil {
+			status = *owner.Status.Value
+		}
+
+		switch status {
+		case models.VirtualMachineWithConfigContextStatusValueOffline,
+			models.VirtualMachineWithConfigContextStatusValueFailed,
+			models.VirtualMachineWithConfigContextStatusValueDecommissioning:
+			return nil
+		}
+
+		seen := n.lastSeen(owner)
+		if n.IPOwnerStaleAfter > 0 && !seen.IsZero() && time.Since(seen) > n.IPOwnerStaleAfter {
+			util.Info("VM %s (#%d) was last seen %s, it is stale", *owner.Name, owner.ID, seen.Format(time.RFC3339))
+			return nil
+		}
+
+		//Owners without a record may be live VMs heard before a restart, they are never stale
+		lastSeen := "never seen by rh-api"
+		if !seen.IsZero() {
+			lastSeen = "last seen " + seen.Format(time.RFC3339)
+		}
+
+		return permanent(fmt.Errorf("ip %s belongs to VM %s (#%d) which is %s and was %s",
+			address, *owner.Name, owner.ID, status, lastSeen))
+	}
+
+	return permanent(fmt.Errorf("ip %s already belongs to VM %s (#%d)", address, *owner.Name, owner.ID))
+}
+
+// lastSeen return when rh-api last received a heartbeat of the VM, or a zero time when it has no record of it
+// Netbox LastUpdated is not used, unchanged heartbeats don't touch the VM
+func (n *Netbox) lastSeen(v *models.VirtualMachineWithConfigContext) time.Time {
+	for _, state := range n.Registry.All() {
+		if state.VmId != v.ID {
+			continue
+		}
+
+		//States recorded before LastSeen existed only know when they were applied
+		if state.LastSeen.IsZero() {
+			return state.AppliedAt
+		}
+
+		return state.LastSeen
+	}
+
+	return time.Time{}
+}
+
+// getInterfaceOwner return the VM owning the interface
+func (n *Netbox) getInterfaceOwner(ctx context.Context, ifId int64) (*models.VirtualMachineWithConfigContext, error) {
+	ifParams := virtualization.NewVirtualizationInterfacesReadParams().
+		WithID(ifId).
+		WithContext(ctx)
+	itf, err := n.Client.Virtualization.VirtualizationInterfacesRead(ifParams, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading virtual machine interface: %w", err)
+	}
+
+	vmParams := virtualization.NewVirtualizationVirtualMachinesReadParams().
+		WithID(itf.Payload.VirtualMachine.ID).
+		WithContext(ctx)
+	owner, err := n.Client.Virtualization.VirtualizationVirtualMachinesRead(vmParams, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading virtual machine #%d: %w", itf.Payload.VirtualMachine.ID, err)
+	}
+
+	return owner.Payload, nil
+}
+
+// clearPrimaryIP unset the IP as primary IP of the VM, when netbox would refuse to move it otherwise
+func (n *Netbox) clearPrimaryIP(ctx context.Context, ip *models.IPAddress, owner *models.VirtualMachineWithConfigContext) error {
+	if !n.Capabilities().PrimaryIPGuarded {
+		return nil
+	}
+
+	data := map[string]interface{}{}
+	if owner.PrimaryIp4 != nil && owner.PrimaryIp4.ID == ip.ID {
+		data["primary_ip4"] = nil
+	}
+	if owner.PrimaryIp6 != nil && owner.PrimaryIp6.ID == ip.ID {
+		data["primary_ip6"] = nil
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	err := n.writeObject(ctx, "/virtualization/virtual-machines/", owner.ID, data, nil)
+	n.cache.forgetVM(*owner.Name, vmSerial(owner))
+	if err != nil {
+		return fmt.Errorf("error unsetting primary ip of VM #%d: %w", owner.ID, err)
+	}
+
+	util.Info("Unset %s as primary IP of VM %s (#%d)", *ip.Address, *owner.Name, owner.ID)
+	return nil
+}
+
+// assignIP link the IP to the interface
+// A previously released IP loses its release tag, so the cleanup leaves it alone
+func (vm *VirtualMachine) assignIP(ctx context.Context, ip *models.IPAddress, ifId int64) error {
+	objectType := "virtualization.vminterface"
+
+	data := vm.n.getIpAddress(*ip.Address)
+	data.DNSName = vm.DNSName()
+	data.AssignedObjectID = &ifId
+	data.AssignedObjectType = &objectType
+
+	object, err := toObject(data)
+	if err != nil {
+		return err
+	}
+
+	//Tags are omitted when empty, so they are set on the generic form to remove the last one
+	if tags, released := withoutTag(ip.Tags, Slugify(vm.n.ReleasedIPTag)); released {
+		object["tags"] = tags
+	}
+
+	err = vm.n.writeObject(ctx, "/ipam/ip-addresses/", ip.ID, object, nil)
+	vm.n.cache.forgetIP(*ip.Address)
+	if err != nil {
+		return fmt.Errorf("error updating ip address: %w", err)
+	}
+
+	util.Success("Update IP to VM interface")
+	return nil
+}
@@ -0,0 +1,178 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/netbox-community/go-netbox/netbox/client/dcim"
+	"github.com/netbox-community/go-netbox/netbox/client/tenancy"
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"os"
+)
+
+// hostAttribute is a VM attribute chosen by the message, by hostname rules or by a default value,
+// then resolved to a netbox ID
+type hostAttribute struct {
+	Default string
+	Rules   []HostRule
+
+	ids *idCache
+}
+
+// newHostAttribute read NETBOX_DEFAULT_<name> and NETBOX_<name>_RULES from the environment
+func newHostAttribute(name string) hostAttribute {
+	return hostAttribute{
+		Default: os.Getenv("NETBOX_DEFAULT_" + name),
+		Rules:   parseHostRules("NETBOX_" + name + "_RULES"),
+
+		ids: newIdCache(),
+	}
+}
+
+// Value return the value of the attribute for the host
+// The message wins over the hostname rules, which win over the default value
+func (a *hostAttribute) Value(fromMsg string, hostname string) string {
+	if fromMsg != "" {
+		return fromMsg
+	}
+
+	if value, ok := matchHostRules(a.Rules, hostname); ok {
+		return value
+	}
+
+	return a.Default
+}
+
+// Resolve return the netbox ID of the attribute for the host, or nil if none is configured
+func (a *hostAttribute) Resolve(ctx context.Context, fromMsg string, hostname string, fetch func(context.Context, string) (int64, error)) (*int64, error) {
+	value := a.Value(fromMsg, hostname)
+	if value == "" {
+		return nil, nil
+	}
+
+	id, err := a.ids.resolve(ctx, value, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &id, nil
+}
+
+// Placement holds the netbox IDs of the objects a VM is attached to
+// Nil fields are left untouched on the VM
+type Placement struct {
+	Site     *int64
+	Tenant   *int64
+	Role     *int64
+	Platform *int64
+}
+
+// GetPlacement resolve the site, tenant, role and platform of the message
+func (n *Netbox) GetPlacement(ctx context.Context, msg Message) (Placement, error) {
+	var (
+		p   Placement
+		err error
+	)
+
+	if p.Site, err = n.Sites.Resolve(ctx, msg.Site, msg.Hostname, n.fetchSiteId); err != nil {
+		return p, fmt.Errorf("error resolving site: %w", err)
+	}
+
+	if p.Tenant, err = n.Tenants.Resolve(ctx, msg.Tenant, msg.Hostname, n.fetchTenantId); err != nil {
+		return p, fmt.Errorf("error resolving tenant: %w", err)
+	}
+
+	if p.Role, err = n.Roles.Resolve(ctx, msg.Role, msg.Hostname, n.fetchRoleId); err != nil {
+		return p, fmt.Errorf("error resolving role: %w", err)
+	}
+
+	if p.Platform, err = n.Platforms.Resolve(ctx, msg.Platform, msg.Hostname, n.fetchPlatformId); err != nil {
+		return p, fmt.Errorf("error resolving platform: %w", err)
+	}
+
+	return p, nil
+}
+
+// Apply copy the placement onto the VM netbox data
+func (p Placement) Apply(conf *models.WritableVirtualMachineWithConfigContext) {
+	if p.Site != nil {
+		conf.Site = p.Site
+	}
+
+	if p.Tenant != nil {
+		conf.Tenant = p.Tenant
+	}
+
+	if p.Role != nil {
+		conf.Role = p.Role
+	}
+
+	if p.Platform != nil {
+		conf.Platform = p.Platform
+	}
+}
+
+func (n *Netbox) fetchSiteId(ctx context.Context, slug string) (int64, error) {
+	params := dcim.NewDcimSitesListParams().
+		WithSlug(&slug).
+		WithContext(ctx)
+	res, err := n.Client.Dcim.DcimSitesList(params, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error listing sites: %w", err)
+	}
+
+	if *res.Payload.Count != 1 {
+		return 0, fmt.Errorf("expected 1 site with slug %s, got %d", slug, *res.Payload.Count)
+	}
+
+	return res.Payload.Results[0].ID, nil
+}
+
+func (n *Netbox) fetchTenantId(ctx context.Context, slug string) (int64, error) {
+	params := tenancy.NewTenancyTenantsListParams().
+		WithSlug(&slug).
+		WithContext(ctx)
+	res, err := n.Client.Tenancy.TenancyTenantsList(params, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error listing tenants: %w", err)
+	}
+
+	if *res.Payload.Count != 1 {
+		return 0, fmt.Errorf("expected 1 tenant with slug %s, got %d", slug, *res.Payload.Count)
+	}
+
+	return res.Payload.Results[0].ID, nil
+}
+
+func (n *Netbox) fetchRoleId(ctx context.Context, slug string) (int64, error) {
+	vmRole := "true"
+	params := dcim.NewDcimDeviceRolesListParams().
+		WithSlug(&slug).
+		WithVMRole(&vmRole).
+		WithContext(ctx)
+	res, err := n.Client.Dcim.DcimDeviceRolesList(params, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error listing device roles: %w", err)
+	}
+
+	if *res.Payload.Count != 1 {
+		return 0, fmt.Errorf("expected 1 VM role with slug %s, got %d", slug, *res.Payload.Count)
+	}
+
+	return res.Payload.Results[0].ID, nil
+}
+
+func (n *Netbox) fetchPlatformId(ctx context.Context, slug string) (int64, error) {
+	params := dcim.NewDcimPlatformsListParams().
+		WithSlug(&slug).
+		WithContext(ctx)
+	res, err := n.Client.Dcim.DcimPlatformsList(params, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error listing platforms: %w", err)
+	}
+
+	if *res.Payload.Count != 1 {
+		return 0, fmt.Errorf("expected 1 platform with slug %s, got %d", slug, *res.Payload.Count)
+	}
+
+	return res.Payload.Results[0].ID, nil
+}
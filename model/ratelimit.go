@@ -0,0 +1,75 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"github.com/go-openapi/runtime"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+// errThrottled wrap the errors of requests which never left the limiter, they say nothing about netbox
+var errThrottled = errors.New("netbox request throttled")
+
+// metrics are published by expvar under "netbox", see METRICS_LISTEN_ADDR
+var metrics = expvar.NewMap("netbox")
+
+// limitedTransport throttle the requests sent to netbox with a token bucket and a max-in-flight cap
+type limitedTransport struct {
+	next    runtime.ClientTransport
+	limiter *rate.Limiter
+	slots   chan struct{}
+}
+
+// newLimitedTransport wrap next, a zero requestsPerSecond or maxInFlight disables the matching limit
+func newLimitedTransport(next runtime.ClientTransport, requestsPerSecond float64, burst int, maxInFlight int) *limitedTransport {
+	t := &limitedTransport{next: next}
+
+	if requestsPerSecond > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		t.limiter = rate.NewLimiter(rate.Limit(requestsPerSecond), burst)
+	}
+
+	if maxInFlight > 0 {
+		t.slots = make(chan struct{}, maxInFlight)
+	}
+
+	return t
+}
+
+func (t *limitedTransport) Submit(op *runtime.ClientOperation) (interface{}, error) {
+	ctx := op.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	start := time.Now()
+
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+			defer func() { <-t.slots }()
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", errThrottled, ctx.Err())
+		}
+	}
+
+	if t.limiter != nil {
+		if err := t.limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("%w: %w", errThrottled, err)
+		}
+	}
+
+	queued := time.Since(start)
+	metrics.Add("requests", 1)
+	metrics.AddFloat("queue_seconds_total", queued.Seconds())
+
+	metrics.Add("in_flight", 1)
+	defer metrics.Add("in_flight", -1)
+
+	return t.next.Submit(op)
+}
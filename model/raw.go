@@ -0,0 +1,72 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
+	"github.com/netbox-community/go-netbox/netbox/client"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// APIError is returned by rawRequest when netbox answers with an unexpected status code
+type APIError struct {
+	Code int
+	Body string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("netbox answered %d: %s", e.Code, e.Body)
+}
+
+// IsNotFound tells if err is a 404 answer from netbox
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// rawRequest call an endpoint which is not covered by the generated go-netbox client
+// The path is relative to the API root, e.g. /virtualization/virtual-disks/
+func (n *Netbox) rawRequest(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	op := &runtime.ClientOperation{
+		ID:                 method + " " + path,
+		Method:             method,
+		PathPattern:        path,
+		ProducesMediaTypes: []string{"application/json"},
+		ConsumesMediaTypes: []string{"application/json"},
+		Schemes:            client.DefaultSchemes,
+		Context:            ctx,
+		Params: runtime.ClientRequestWriterFunc(func(req runtime.ClientRequest, _ strfmt.Registry) error {
+			for k, v := range query {
+				if err := req.SetQueryParam(k, v...); err != nil {
+					return err
+				}
+			}
+
+			if body != nil {
+				return req.SetBodyParam(body)
+			}
+
+			return nil
+		}),
+		Reader: runtime.ClientResponseReaderFunc(func(resp runtime.ClientResponse, consumer runtime.Consumer) (interface{}, error) {
+			if resp.Code() < 200 || resp.Code() >= 300 {
+				content, _ := io.ReadAll(resp.Body())
+				return nil, &APIError{Code: resp.Code(), Body: string(content)}
+			}
+
+			if out != nil && resp.Code() != http.StatusNoContent {
+				if err := consumer.Consume(resp.Body(), out); err != nil {
+					return nil, err
+				}
+			}
+
+			return out, nil
+		}),
+	}
+
+	_, err := n.Client.Transport.Submit(op)
+	return err
+}
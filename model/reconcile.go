@@ -0,0 +1,194 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/netbox-community/go-netbox/netbox/client/virtualization"
+	"github.com/netbox-community/go-netbox/netbox/models"
+	"strconv"
+	"strings"
+)
+
+// Reconciliation modes, telling if drift is only reported or also corrected
+const (
+	ReconcileModeReport  = "report"
+	ReconcileModeCorrect = "correct"
+)
+
+// Drift is a difference between the last known agent state and netbox
+type Drift struct {
+	Hostname string   `json:"hostname"`
+	Problems []string `json:"problems"`
+}
+
+// ReconcileReport sums up a reconciliation run
+type ReconcileReport struct {
+	Checked   int      `json:"checked"`
+	Drifts    []Drift  `json:"drifts"`
+	Corrected int      `json:"corrected"`
+	Unknown   []string `json:"unknown"`
+}
+
+// Reconcile compare every host of the registry with the VMs of the managed clusters
+// In correct mode, drifted hosts are registered again from their last known message
+func (n *Netbox) Reconcile(ctx context.Context) (ReconcileReport, error) {
+	var report ReconcileReport
+
+	//Drift must be checked against netbox itself
+	n.cache.purge()
+
+	vms, err := n.listManagedVMs(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	bySerial := map[string]*models.VirtualMachineWithConfigContext{}
+	byName := map[string]*models.VirtualMachineWithConfigContext{}
+	for _, v := range vms {
+		byName[*v.Name] = v
+		if serial := vmSerial(v); serial != "" {
+			bySerial[serial] = v
+		}
+	}
+
+	known := map[int64]bool{}
+	for _, state := range n.Registry.All() {
+		msg := state.Message
+		report.Checked++
+
+		v, ok := bySerial[msg.GetSerial()]
+		if !ok {
+			v = byName[msg.Hostname]
+		}
+
+		var problems []string
+		if v == nil {
+			problems = []string{"virtual machine is missing"}
+		} else {
+			known[v.ID] = true
+			problems, err = n.checkDrift(ctx, msg, v)
+			if err != nil {
+				return report, err
+			}
+		}
+
+		if len(problems) == 0 {
+			continue
+		}
+
+		util.Warn("Drift detected on %s: %s", msg.Hostname, strings.Join(problems, ", "))
+		report.Drifts = append(report.Drifts, Drift{Hostname: msg.Hostname, Problems: problems})
+
+		//The stored VM no longer exists, the next registration must create it rather than update it
+		if v == nil {
+			n.Registry.ForgetObjects(hostKey(msg))
+		}
+
+		if n.ReconcileMode != ReconcileModeCorrect {
+			//Make sure the next heartbeat of the host is fully applied
+			n.Registry.InvalidateHash(hostKey(msg))
+			continue
+		}
+
+		if err := n.createOrUpdateVM(ctx, &msg, true); err != nil {
+			util.Warn("Unable to correct drift on %s: %s", msg.Hostname, err)
+			continue
+		}
+
+		report.Corrected++
+	}
+
+	for _, v := range vms {
+		if !known[v.ID] {
+			report.Unknown = append(report.Unknown, *v.Name)
+		}
+	}
+
+	return report, nil
+}
+
+// checkDrift list what differs between the last known message of a host and its netbox VM
+func (n *Netbox) checkDrift(ctx context.Context, msg Message, v *models.VirtualMachineWithConfigContext) ([]string, error) {
+	var problems []string
+
+	if serial := vmSerial(v); serial != msg.GetSerial() {
+		problems = append(problems, fmt.Sprintf("serial is %q instead of %q", serial, msg.GetSerial()))
+	}
+
+	if *v.Name != msg.Hostname {
+		problems = append(problems, fmt.Sprintf("name is %q instead of %q", *v.Name, msg.Hostname))
+	}
+
+	vm := NewVM(n, msg)
+	vm.NetboxId = v.ID
+
+	interfaces, err := vm.GetInterfaces(ctx, mgmtInterfaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if *interfaces.Payload.Count == 0 {
+		return append(problems, "management interface is missing"), nil
+	}
+
+	ip, err := vm.GetManagementIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip == nil {
+		problems = append(problems, "management IP is missing")
+	} else if hostAddress(*ip.Address) != hostAddress(msg.IpAddress) {
+		problems = append(problems, fmt.Sprintf("management IP is %s instead of %s", *ip.Address, msg.IpAddress))
+	}
+
+	return problems, nil
+}
+
+// listManagedVMs load the VMs of the managed clusters, or every VM when no cluster is configured
+func (n *Netbox) listManagedVMs(ctx context.Context) ([]*models.VirtualMachineWithConfigContext, error) {
+	clusters := n.managedClusterNames()
+	if len(clusters) == 0 {
+		return n.listVMs(ctx, nil)
+	}
+
+	var vms []*models.VirtualMachineWithConfigContext
+	for _, name := range clusters {
+		id, err := n.Clusters.ids.resolve(ctx, name, n.fetchClusterId)
+		if err != nil {
+			return nil, err
+		}
+
+		clusterId := strconv.FormatInt(id, 10)
+		clusterVMs, err := n.listVMs(ctx, &clusterId)
+		if err != nil {
+			return nil, err
+		}
+
+		vms = append(vms, clusterVMs...)
+	}
+
+	return vms, nil
+}
+
+func (n *Netbox) listVMs(ctx context.Context, clusterId *string) ([]*models.VirtualMachineWithConfigContext, error) {
+	limit := int64(0)
+	params := virtualization.NewVirtualizationVirtualMachinesListParams().
+		WithClusterID(clusterId).
+		WithLimit(&limit).
+		WithContext(ctx)
+	res, err := n.Client.Virtualization.VirtualizationVirtualMachinesList(params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get list of machines from netbox: %w", err)
+	}
+
+	return res.Payload.Results, nil
+}
+
+// vmSerial read the serial custom field of a netbox VM
+func vmSerial(v *models.VirtualMachineWithConfigContext) string {
+	cf, _ := v.CustomFields.(map[string]interface{})
+	serial, _ := cf[serialCustomField].(string)
+	return serial
+}
@@ -0,0 +1,226 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var hostsBucket = []byte("hosts")
+
+// HostState is the last registration applied for a host, with the netbox objects it resolved to
+type HostState struct {
+	Message     Message   `json:"message"`
+	VmId        int64     `json:"vm_id"`
+	InterfaceId int64     `json:"interface_id"`
+	IpId        int64     `json:"ip_id"`
+	PayloadHash string    `json:"payload_hash"`
+	AppliedAt   time.Time `json:"applied_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// Registry remember the last state applied for every host, keyed by hostKey
+// When opened with OpenRegistry, states are persisted to a BoltDB file and survive restarts
+type Registry struct {
+	mu    sync.RWMutex
+	hosts map[string]HostState
+	db    *bolt.DB
+}
+
+// NewRegistry return an empty in-memory registry
+func NewRegistry() *Registry {
+	return &Registry{hosts: map[string]HostState{}}
+}
+
+// OpenRegistry open (or create) the registry file and load the states it holds
+func OpenRegistry(path string) (*Registry, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening state file %s: %w", path, err)
+	}
+
+	r := NewRegistry()
+	r.db = db
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(hostsBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var state HostState
+			if err := json.Unmarshal(v, &state); err != nil {
+				util.Warn("Ignoring corrupted state of host %s: %s", k, err)
+				return nil
+			}
+
+			r.hosts[string(k)] = state
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error loading state file %s: %w", path, err)
+	}
+
+	util.Info("Loaded state of %d host(s) from %s", len(r.hosts), path)
+	return r, nil
+}
+
+// Close release the registry file
+func (r *Registry) Close() error {
+	if r.db == nil {
+		return nil
+	}
+
+	return r.db.Close()
+}
+
+// hostKey identify the host of the message, by its serial or by its hostname when it has none
+func hostKey(msg Message) string {
+	if serial := msg.GetSerial(); serial != "" {
+		return serial
+	}
+
+	return "hostname:" + msg.Hostname
+}
+
+// Record store the state of a host
+func (r *Registry) Record(state HostState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	//Result fields describe one processing, they are not part of the host state
+	state.Message.PlannedActions = nil
+	state.Message.PreviousIPOwner = nil
+
+	key := hostKey(state.Message)
+	r.hosts[key] = state
+	r.persist(key, state)
+}
+
+// InvalidateHash clear the payload hash of the host, so its next message is fully applied
+// Unlike recording a modified copy, it can't overwrite a state recorded in the meantime
+func (r *Registry) InvalidateHash(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, ok := r.hosts[key]
+	if !ok {
+		return
+	}
+
+	state.PayloadHash = ""
+	r.hosts[key] = state
+	r.persist(key, state)
+}
+
+// ForgetObjects clear the netbox objects and the payload hash of the host, its next registration looks them up again
+// It is used when the VM was deleted from netbox, so the host is registered again instead of updating a missing VM
+func (r *Registry) ForgetObjects(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, ok := r.hosts[key]
+	if !ok {
+		return
+	}
+
+	state.VmId, state.InterfaceId, state.IpId = 0, 0, 0
+	state.PayloadHash = ""
+	r.hosts[key] = state
+	r.persist(key, state)
+}
+
+// persist write the state to the registry file, if any, the caller must hold the lock
+func (r *Registry) persist(key string, state HostState) {
+	if r.db == nil {
+		return
+	}
+
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(hostsBucket).Put([]byte(key), data)
+	})
+	if err != nil {
+		util.Warn("Unable to persist state of host %s: %s", key, err)
+	}
+}
+
+// Touch record that the host just sent a heartbeat, even one skipped as unchanged
+func (r *Registry) Touch(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, ok := r.hosts[key]
+	if !ok {
+		return
+	}
+
+	state.LastSeen = time.Now()
+	r.hosts[key] = state
+	r.persist(key, state)
+}
+
+// Forget remove the state of the host with the given key
+func (r *Registry) Forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.hosts, key)
+
+	if r.db == nil {
+		return
+	}
+
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(hostsBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		util.Warn("Unable to forget state of host %s: %s", key, err)
+	}
+}
+
+// Get return the state of the host with the given key
+func (r *Registry) Get(key string) (HostState, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	state, ok := r.hosts[key]
+	return state, ok
+}
+
+// All return a copy of every known host state
+func (r *Registry) All() []HostState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	states := make([]HostState, 0, len(r.hosts))
+	for _, state := range r.hosts {
+		states = append(states, state)
+	}
+
+	return states
+}
+
+// PayloadHash fingerprint what the agent reported, ignoring delivery details
+func PayloadHash(msg Message) string {
+	msg.MessageId = ""
+	msg.FailCount = 0
+	msg.PlannedActions = nil
+	msg.PreviousIPOwner = nil
+
+	data, _ := json.Marshal(msg)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,95 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/KittenConnect/rh-api/util"
+	"github.com/go-openapi/runtime"
+	runtimeclient "github.com/go-openapi/runtime/client"
+	"github.com/netbox-community/go-netbox/netbox/client"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// deadlineTransport bound every request with the read or write timeout, within the deadline of its context
+// The runtime ignores the timeout of the params as soon as a context is given, so it is applied here
+type deadlineTransport struct {
+	next  runtime.ClientTransport
+	read  time.Duration
+	write time.Duration
+}
+
+func (t *deadlineTransport) Submit(op *runtime.ClientOperation) (interface{}, error) {
+	timeout := t.write
+	if op.Method == http.MethodGet {
+		timeout = t.read
+	}
+
+	ctx := op.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	//The response is read before Submit returns, so the context can be released right after
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	bounded := *op
+	bounded.Context = ctx
+	return t.next.Submit(&bounded)
+}
+
+// newAPITransport build the transport reaching the netbox API, authenticated with the token
+// The URL is either a host, e.g. netbox:8080, or a full URL, e.g. https://netbox.example.com/api
+// timeout bounds every HTTP exchange, body included, whatever the context of the request
+func newAPITransport(apiURL string, token string, timeout time.Duration) (runtime.ClientTransport, error) {
+	scheme, host, basePath := "http", apiURL, client.DefaultBasePath
+	if strings.Contains(apiURL, "://") {
+		u, err := url.Parse(apiURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NETBOX_API_URL: %w", err)
+		}
+
+		scheme, host = u.Scheme, u.Host
+		if path := strings.TrimSuffix(u.Path, "/"); path != "" {
+			basePath = path
+		}
+	}
+
+	httpClient, err := newHTTPClient(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	t := runtimeclient.NewWithClient(host, basePath, []string{scheme}, httpClient)
+	t.DefaultAuthentication = runtimeclient.APIKeyAuth("Authorization", "header", "Token "+token)
+	return t, nil
+}
+
+// newHTTPClient build the HTTP client used to reach netbox, with the TLS settings (NETBOX_TLS_*)
+// and the proxy (NETBOX_HTTP_PROXY, or the usual HTTP_PROXY variables) of the environment
+func newHTTPClient(timeout time.Duration) (*http.Client, error) {
+	tlsConfig, err := util.GetEnvTLSConfig("NETBOX")
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if proxy := os.Getenv("NETBOX_HTTP_PROXY"); proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid NETBOX_HTTP_PROXY: %w", err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
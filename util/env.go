@@ -0,0 +1,104 @@
+package util
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetEnv returns the value of the environment variable or def if it is unset or empty
+func GetEnv(key string, def string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+
+	return def
+}
+
+// GetEnvInt returns the environment variable parsed as an int, or def if it is unset or invalid
+func GetEnvInt(key string, def int) int {
+	if value, ok := os.LookupEnv(key); ok {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+
+		Warn("Invalid integer value %q for %s, using default %d", value, key, def)
+	}
+
+	return def
+}
+
+// GetEnvFloat returns the environment variable parsed as a float, or def if it is unset or invalid
+func GetEnvFloat(key string, def float64) float64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+
+		Warn("Invalid number value %q for %s, using default %g", value, key, def)
+	}
+
+	return def
+}
+
+// GetEnvBool returns the environment variable parsed as a bool, or def if it is unset or invalid
+func GetEnvBool(key string, def bool) bool {
+	if value, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+
+		Warn("Invalid boolean value %q for %s, using default %t", value, key, def)
+	}
+
+	return def
+}
+
+// GetEnvList returns the environment variable split on commas, with blank entries removed
+func GetEnvList(key string) []string {
+	var list []string
+
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// GetEnvDuration returns the environment variable parsed as a duration, or def if it is unset or invalid
+// Plain integers are read as seconds
+func GetEnvDuration(key string, def time.Duration) time.Duration {
+	if value, ok := os.LookupEnv(key); ok {
+		if i, err := strconv.Atoi(value); err == nil {
+			return time.Duration(i) * time.Second
+		}
+
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+
+		Warn("Invalid duration value %q for %s, using default %s", value, key, def)
+	}
+
+	return def
+}
+
+// GetEnvMap returns the environment variable parsed as a comma separated list of key=value pairs
+func GetEnvMap(key string) map[string]string {
+	m := map[string]string{}
+
+	for _, pair := range GetEnvList(key) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			Warn("Ignoring invalid entry %q in %s, expected key=value", pair, key)
+			continue
+		}
+
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return m
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// GetEnvTLSConfig builds a TLS configuration from the <prefix>_TLS_CA, <prefix>_TLS_CERT, <prefix>_TLS_KEY,
+// <prefix>_TLS_SERVER_NAME and <prefix>_TLS_INSECURE environment variables
+// It returns nil when none of them is set, so the defaults of the client apply
+func GetEnvTLSConfig(prefix string) (*tls.Config, error) {
+	var (
+		ca         = os.Getenv(prefix + "_TLS_CA")
+		cert       = os.Getenv(prefix + "_TLS_CERT")
+		key        = os.Getenv(prefix + "_TLS_KEY")
+		serverName = os.Getenv(prefix + "_TLS_SERVER_NAME")
+		insecure   = GetEnvBool(prefix+"_TLS_INSECURE", false)
+	)
+
+	if ca == "" && cert == "" && key == "" && serverName == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure}
+
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s_TLS_CA: %w", prefix, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", ca)
+		}
+	}
+
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s_TLS_CERT and %s_TLS_KEY: %w", prefix, prefix, err)
+		}
+
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	if insecure {
+		Warn("TLS certificate verification is disabled by %s_TLS_INSECURE", prefix)
+	}
+
+	return config, nil
+}